@@ -0,0 +1,133 @@
+package rpcdb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrSessionNotAllowed is returned by BuildSession when the
+// Debug-Session URL is not one the middleware may call
+var ErrSessionNotAllowed = errors.New("debug session not allowed")
+
+// SessionPattern describes debugger URLs the middleware may call, in
+// the form `[scheme://]host[:port]`. host is either a glob on the host
+// name (see path.Match), such as `*.rpcdbd.internal`, or a CIDR block,
+// such as `10.20.0.0/16`, which only matches URLs with a literal IP
+// address. An IPv6 block is written in brackets, `[fd00::]/8`. A
+// missing scheme allows http and https, a missing port, or `*`,
+// allows any port.
+type SessionPattern struct {
+	Scheme string
+	Host   string
+	Net    *net.IPNet
+	Port   string
+}
+
+// ParseSessionPattern parses an allowed session URL pattern
+func ParseSessionPattern(s string) (SessionPattern, error) {
+	p := SessionPattern{}
+	rest := s
+	if i := strings.Index(rest, "://"); i >= 0 {
+		p.Scheme, rest = strings.ToLower(rest[:i]), rest[i+3:]
+		if p.Scheme != "http" && p.Scheme != "https" {
+			return p, fmt.Errorf("session pattern '%s' must be http or https", s)
+		}
+	}
+
+	host := rest
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return p, fmt.Errorf("malformed session pattern '%s'", s)
+		}
+		host, rest = rest[1:end], rest[end+1:]
+		// a network's prefix length follows the brackets
+		if strings.HasPrefix(rest, "/") {
+			bits := rest
+			if colon := strings.Index(rest, ":"); colon >= 0 {
+				bits, rest = rest[:colon], rest[colon:]
+			} else {
+				rest = ""
+			}
+			host += bits
+		}
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			return p, fmt.Errorf("malformed session pattern '%s'", s)
+		}
+		rest = strings.TrimPrefix(rest, ":")
+	} else if colon := strings.LastIndex(rest, ":"); colon >= 0 {
+		host, rest = rest[:colon], rest[colon+1:]
+	} else {
+		rest = ""
+	}
+	p.Port = rest
+	if p.Port == "*" {
+		p.Port = ""
+	}
+	if host == "" {
+		return p, fmt.Errorf("session pattern '%s' has no host", s)
+	}
+
+	if strings.Contains(host, "/") {
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return p, fmt.Errorf("malformed network in session pattern '%s': %s", s, err)
+		}
+		p.Net = n
+	} else {
+		if _, err := path.Match(host, ""); err != nil {
+			return p, fmt.Errorf("malformed session pattern '%s': %s", s, err)
+		}
+		p.Host = strings.ToLower(host)
+	}
+	return p, nil
+}
+
+// Allows reports whether the pattern allows calling u
+func (p SessionPattern) Allows(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return false
+	}
+	if p.Scheme != "" && p.Scheme != scheme {
+		return false
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[scheme]
+	}
+	if p.Port != "" && p.Port != port {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if p.Net != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && p.Net.Contains(ip)
+	}
+	ok, err := path.Match(p.Host, host)
+	return err == nil && ok
+}
+
+// allowSession checks a Debug-Session URL against the allowed patterns.
+// Without any patterns every http and https URL is allowed.
+func allowSession(sessionURL string, allowed []SessionPattern) error {
+	u, err := url.Parse(sessionURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: malformed session url '%s'", ErrSessionNotAllowed, sessionURL)
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, p := range allowed {
+		if p.Allows(u) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s' is not an allowed debugger", ErrSessionNotAllowed, sessionURL)
+}
@@ -0,0 +1,118 @@
+package rpcdb
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSessionPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		url     string
+		allowed bool
+	}{
+		{"https://rpcdbd.internal", "https://rpcdbd.internal/abc123", true},
+		{"https://rpcdbd.internal", "http://rpcdbd.internal/abc123", false},
+		{"rpcdbd.internal", "http://rpcdbd.internal:8080/abc123", true},
+		{"rpcdbd.internal:8080", "http://rpcdbd.internal:9090/abc123", false},
+		{"https://rpcdbd.internal:443", "https://rpcdbd.internal/abc123", true},
+		{"*.debug.internal", "https://a.debug.internal/abc123", true},
+		{"*.debug.internal", "https://debug.internal.evil.com/abc123", false},
+		{"10.20.0.0/16", "http://10.20.1.2:7000/abc123", true},
+		{"10.20.0.0/16:7000", "http://10.20.1.2:7001/abc123", false},
+		{"10.20.0.0/16", "http://10.21.1.2/abc123", false},
+		{"10.20.0.0/16", "http://host.internal/abc123", false},
+		{"[fd00::]/8:7000", "http://[fd12::1]:7000/abc123", true},
+		{"*", "file:///etc/passwd", false},
+	} {
+		p, err := ParseSessionPattern(c.pattern)
+		if err != nil {
+			t.Errorf("unexpected error parsing '%s': %s", c.pattern, err)
+			continue
+		}
+		u, _ := url.Parse(c.url)
+		if p.Allows(u) != c.allowed {
+			t.Errorf("expected '%s' allowing '%s' to be %t", c.pattern, c.url, c.allowed)
+		}
+	}
+
+	for _, bad := range []string{"ftp://rpcdbd.internal", "10.0.0.0/33", "[fd00::", ":8080", "[a-"} {
+		if _, err := ParseSessionPattern(bad); err == nil {
+			t.Errorf("expected error parsing '%s'", bad)
+		}
+	}
+}
+
+func TestBuildSessionAllowList(t *testing.T) {
+	h := http.Header{}
+	h.Add("Debug-Session", "http://169.254.169.254/latest/meta-data")
+	h.Add("Debug-Breakpoint", "receive example:*")
+
+	rejected := func() string {
+		if v := stats.Get("sessions_rejected"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	before := rejected()
+	_, err := BuildSession(Identity{Service: "example"}, h, WithAllowedSessions("https://rpcdbd.internal", "10.0.0.0/8"))
+	if !errors.Is(err, ErrSessionNotAllowed) {
+		t.Errorf("expected session to be refused, got %v", err)
+	}
+	if rejected() == before {
+		t.Error("expected the rejection to be counted")
+	}
+
+	if _, err := BuildSession(Identity{Service: "example"}, h); err != nil {
+		t.Errorf("expected any session to be allowed without an allow list, got %s", err)
+	}
+}
+
+func TestMiddlewareIgnoresDisallowedSession(t *testing.T) {
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1,"action":"abort"}` })
+	defer ds.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil},
+		WithAllowedSessions("https://rpcdbd.internal"),
+		WithLogger(func(string, ...interface{}) {}))
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != 200 || w.Body.String() != "hello world" || len(events()) != 0 {
+		t.Errorf("expected disallowed session to be served normally, got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestDebuggerRedirectsNotFollowed(t *testing.T) {
+	redirected := false
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+		w.Write([]byte(`{"version":1,"action":"abort"}`))
+	}))
+	defer elsewhere.Close()
+
+	for _, code := range []int{http.StatusTemporaryRedirect, http.StatusSeeOther} {
+		ds := httptest.NewServer(http.RedirectHandler(elsewhere.URL, code))
+		allowed := strings.TrimPrefix(ds.URL, "http://")
+
+		for _, opts := range [][]Option{nil, {WithHTTPClient(http.DefaultClient)}} {
+			opts = append(opts, WithAllowedSessions(allowed), WithFailurePolicy(FailOpen),
+				WithLogger(func(string, ...interface{}) {}))
+			m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}, opts...)
+			for _, bp := range []string{"receive example:/hello", "receive example:/hello once"} {
+				w := httptest.NewRecorder()
+				m.ServeHTTP(w, debugRequest(t, ds.URL, bp))
+				if w.Code != 200 || redirected {
+					t.Errorf("expected a %d from the debugger not to be followed for '%s', got %d", code, bp, w.Code)
+				}
+			}
+		}
+		ds.Close()
+	}
+	if http.DefaultClient.CheckRedirect != nil {
+		t.Error("expected WithHTTPClient to leave the client given to it alone")
+	}
+}
@@ -0,0 +1,173 @@
+package rpcdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultBodyLimit is how much of a body is held in memory for the
+// debugger unless configured otherwise, see WithBodyLimit
+const DefaultBodyLimit = 1 << 20
+
+// payload is a body as captured for the debugger. A body over the
+// limit keeps only its first limit bytes in head, and is either
+// truncated, with the rest left unread in the original stream, or
+// spooled, with the rest read into a temporary file.
+type payload struct {
+	head      []byte
+	truncated bool
+	rest      io.ReadCloser
+	spool     *os.File
+	size      int64
+}
+
+// capture reads up to limit bytes of body for the debugger. size is
+// the length of the whole body if it is known, otherwise -1. With no
+// limit, or a body within it, the body is read and closed.
+func capture(body io.ReadCloser, size, limit int64, spool bool, dir string) (*payload, error) {
+	if body == nil {
+		return &payload{}, nil
+	}
+	if limit <= 0 {
+		defer body.Close()
+		b, err := ioutil.ReadAll(body)
+		return &payload{head: b, size: int64(len(b))}, err
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if int64(len(b)) <= limit {
+		body.Close()
+		return &payload{head: b, size: int64(len(b))}, nil
+	}
+	head, over := b[:limit], b[limit:]
+	if !spool {
+		rest := readCloser{io.MultiReader(bytes.NewReader(over), body), body}
+		return &payload{head: head, truncated: true, rest: rest, size: size}, nil
+	}
+
+	defer body.Close()
+	f, err := ioutil.TempFile(dir, "rpcdb-body-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to spool body: %s", err)
+	}
+	p := &payload{head: head, spool: f}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(over), body))
+	if err != nil {
+		p.discard()
+		return nil, err
+	}
+	p.size = limit + n
+	return p, nil
+}
+
+// reader reads the captured body from the start, which for a truncated
+// body is just its head
+func (p *payload) reader() io.Reader {
+	if p.spool == nil {
+		return bytes.NewReader(p.head)
+	}
+	return io.MultiReader(bytes.NewReader(p.head), io.NewSectionReader(p.spool, 0, p.size-int64(len(p.head))))
+}
+
+// len is the length of what reader reads
+func (p *payload) len() int64 {
+	if p.spool == nil {
+		return int64(len(p.head))
+	}
+	return p.size
+}
+
+// replay returns the whole body, unchanged, to be sent on in place of
+// the one captured. Closing it cleans up after the payload.
+func (p *payload) replay() io.ReadCloser {
+	if p.truncated {
+		return readCloser{io.MultiReader(bytes.NewReader(p.head), p.rest), p.rest}
+	}
+	return readCloser{p.reader(), closerFunc(p.discard)}
+}
+
+// discard closes what is left of the original body, and removes any
+// spool file
+func (p *payload) discard() error {
+	if p.rest != nil {
+		p.rest.Close()
+	}
+	if p.spool != nil {
+		p.spool.Close()
+		return os.Remove(p.spool.Name())
+	}
+	return nil
+}
+
+// encode describes the payload in an event. The data of a spooled body
+// is left out, to be streamed to the debugger by encodeEvent.
+func (p *payload) encode() Body {
+	if p.spool != nil {
+		return Body{Encoding: "base64", Size: p.size}
+	}
+	b := NewBody(p.head)
+	if p.truncated {
+		b.Truncated = true
+		if p.size > 0 {
+			b.Size = p.size
+		}
+	}
+	return b
+}
+
+// spooledMarker stands in for the data of a spooled body while its
+// event is encoded
+const spooledMarker = "rpcdb:spooled-body"
+
+// encodeEvent encodes ev as JSON to be sent to the debugger, streaming
+// the data of a spooled body from disk rather than holding it in memory
+func encodeEvent(ev Event) (io.ReadCloser, error) {
+	if ev.spooled == nil {
+		b, err := json.Marshal(ev)
+		return ioutil.NopCloser(bytes.NewReader(b)), err
+	}
+
+	ev.Body.Data = spooledMarker
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	// the body comes after anything else which might hold the marker
+	i := bytes.LastIndex(b, []byte(`"`+spooledMarker+`"`))
+	if i < 0 {
+		return nil, fmt.Errorf("unable to place spooled body")
+	}
+	before, after := b[:i+1], b[i+1+len(spooledMarker):]
+
+	pr, pw := io.Pipe()
+	go func(body io.Reader) {
+		enc := base64.NewEncoder(base64.StdEncoding, pw)
+		_, err := io.Copy(enc, body)
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}(ev.spooled.reader())
+	r := io.MultiReader(bytes.NewReader(before), pr, bytes.NewReader(after))
+	return readCloser{r, pr}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,145 @@
+package rpcdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureTruncates(t *testing.T) {
+	p, err := capture(ioutil.NopCloser(strings.NewReader("hello world")), 11, 4, false, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(p.head) != "hell" || !p.truncated {
+		t.Errorf("expected truncated head 'hell', got '%s' %t", p.head, p.truncated)
+	}
+	if b := p.encode(); b.Data != "hell" || !b.Truncated || b.Size != 11 {
+		t.Errorf("expected the event to mark the body truncated, got %+v", b)
+	}
+	replayed, _ := ioutil.ReadAll(p.replay())
+	if string(replayed) != "hello world" {
+		t.Errorf("expected the whole body to be replayed, got '%s'", replayed)
+	}
+}
+
+func TestCaptureSpools(t *testing.T) {
+	dir := t.TempDir()
+	p, err := capture(ioutil.NopCloser(strings.NewReader("hello world")), -1, 4, true, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(p.head) != "hell" || p.size != 11 {
+		t.Errorf("expected head 'hell' of 11 bytes, got '%s' %d", p.head, p.size)
+	}
+
+	r, err := encodeEvent(Event{Body: p.encode(), spooled: p})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ev := Event{}
+	if err := json.NewDecoder(r).Decode(&ev); err != nil {
+		t.Fatalf("unable to decode streamed event: %s", err)
+	}
+	r.Close()
+	if b, _ := ev.Body.Bytes(); string(b) != "hello world" || ev.Body.Truncated {
+		t.Errorf("expected the whole body to be streamed, got '%s' %+v", b, ev.Body)
+	}
+
+	replay := p.replay()
+	replayed, _ := ioutil.ReadAll(replay)
+	if string(replayed) != "hello world" {
+		t.Errorf("expected the whole body to be replayed, got '%s'", replayed)
+	}
+	replay.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("expected spool file to be removed, found %v", files)
+	}
+}
+
+func TestReceiveBodyLimit(t *testing.T) {
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+	h := &recordingHandler{}
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, h, WithBodyLimit(4, Receive))
+
+	m.ServeHTTP(httptest.NewRecorder(), debugRequest(t, ds.URL, "receive example:/hello"))
+	if h.body != "hello world" {
+		t.Errorf("expected the handler to get the whole body, got '%s'", h.body)
+	}
+	evs := events()
+	if len(evs) != 1 || evs[0].Body.Data != "hell" || !evs[0].Body.Truncated || evs[0].Body.Size != 11 {
+		t.Errorf("expected the debugger to get the truncated body, got %+v", evs)
+	}
+}
+
+func TestReplyBodyLimit(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 100)
+	serve := func(t *testing.T, verdict string, opts ...Option) (string, []Event) {
+		ds, events := recordingDebugger(func(Event) string { return verdict })
+		defer ds.Close()
+		ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(big[:500])
+			w.Write(big[500:])
+		}), opts...))
+		defer ts.Close()
+
+		resp, err := http.DefaultClient.Do(debugGet(t, ts.URL, ds.URL, "reply example:/hello"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), events()
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		body, evs := serve(t, `{"version":1}`, WithBodyLimit(100, Reply))
+		if body != string(big) {
+			t.Errorf("expected the whole reply to pass through, got %d bytes", len(body))
+		}
+		if len(evs) != 1 || evs[0].Body.Data != string(big[:100]) || !evs[0].Body.Truncated {
+			t.Errorf("expected one event with the truncated reply, got %+v", evs)
+		}
+	})
+
+	t.Run("buffer limit", func(t *testing.T) {
+		body, evs := serve(t, `{"version":1}`, WithMaxBufferedBytes(700))
+		if body != string(big) {
+			t.Errorf("expected the whole reply to pass through, got %d bytes", len(body))
+		}
+		if len(evs) != 1 || evs[0].Body.Data != string(big[:500]) || !evs[0].Body.Truncated {
+			t.Errorf("expected the reply truncated at the buffer limit, got %+v", evs)
+		}
+	})
+
+	t.Run("spool", func(t *testing.T) {
+		dir := t.TempDir()
+		body, evs := serve(t, `{"version":1}`, WithBodyLimit(100, Reply), WithBodySpool(dir))
+		if body != string(big) {
+			t.Errorf("expected the whole reply to pass through, got %d bytes", len(body))
+		}
+		if len(evs) != 1 {
+			t.Fatalf("expected one event, got %d", len(evs))
+		}
+		if b, _ := evs[0].Body.Bytes(); !bytes.Equal(b, big) || evs[0].Body.Size != int64(len(big)) {
+			t.Errorf("expected the debugger to get the whole reply, got %d bytes", len(b))
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Errorf("expected spool file to be removed, found %d", len(files))
+		}
+	})
+
+	t.Run("modify", func(t *testing.T) {
+		body, _ := serve(t, `{"version":1,"action":"modify","body":{"encoding":"text","data":"replaced"}}`, WithBodyLimit(100, Reply))
+		if body != "replaced" {
+			t.Errorf("expected the debugger's body in place of the rest of the reply, got '%s'", body)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package rpcdb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var debugBudgetHeaderKey = http.CanonicalHeaderKey("Debug-Budget")
+
+// DefaultBudget is how long an RPC may spend paused at breakpoints
+// when the session does not say, and has no expiry to go by
+const DefaultBudget = 10 * time.Minute
+
+// keepAliveInterval is how often the middleware sends a 102 Processing
+// response while paused, so that proxies do not give up on the client
+var keepAliveInterval = 15 * time.Second
+
+// parseBudget parses a Debug-Budget header, which is either a number of
+// seconds or a duration such as `5m`, and caps it at the time left
+// before the session expires
+func parseBudget(value string, expires time.Time, now time.Time) time.Duration {
+	budget := DefaultBudget
+	if secs, err := strconv.Atoi(value); err == nil {
+		budget = time.Duration(secs) * time.Second
+	} else if d, err := time.ParseDuration(value); err == nil {
+		budget = d
+	} else if !expires.IsZero() {
+		budget = expires.Sub(now)
+	}
+	if !expires.IsZero() && expires.Sub(now) < budget {
+		budget = expires.Sub(now)
+	}
+	if budget < 0 {
+		budget = 0
+	}
+	return budget
+}
+
+// remaining is how much of the session's budget is left for pausing
+func (s *Session) remaining() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused >= s.Budget {
+		return 0
+	}
+	return s.Budget - s.paused
+}
+
+// extendDeadlines pushes the server's read and write deadlines for a
+// request back by the remaining budget, so that time paused at
+// breakpoints does not count against its timeouts. Deadlines are left
+// alone when the server has no timeouts, or there is no budget left.
+func (s *Session) extendDeadlines(w http.ResponseWriter, req *http.Request) {
+	remaining := s.remaining()
+	srv, ok := req.Context().Value(http.ServerContextKey).(*http.Server)
+	if remaining == 0 || !ok {
+		return
+	}
+	rc := http.NewResponseController(w)
+	now := time.Now()
+	if srv.ReadTimeout > 0 {
+		rc.SetReadDeadline(now.Add(srv.ReadTimeout + remaining))
+	}
+	if srv.WriteTimeout > 0 {
+		rc.SetWriteDeadline(now.Add(srv.WriteTimeout + remaining))
+	}
+}
+
+// formatBudget renders a budget for the Debug-Budget header, rounded
+// down to the millisecond so a hop is never given more than is left
+func formatBudget(budget time.Duration) string {
+	if budget < 0 {
+		budget = 0
+	}
+	return strconv.FormatInt(int64(budget/time.Millisecond), 10) + "ms"
+}
+
+// pausedFor records time spent waiting on the debugger
+func (s *Session) pausedFor(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused += d
+}
+
+// pause returns the context a call to the debugger is made in. It is
+// free of ctx's deadline, as the whole point is to wait on a human,
+// but is bounded by what is left of the budget and is still cancelled
+// if ctx is, say because the client went away.
+func (s *Session) pause(ctx context.Context) (context.Context, context.CancelFunc) {
+	return detach(ctx, time.Now().Add(s.remaining()))
+}
+
+// extend returns ctx with its deadline, if it has one, pushed back by
+// the remaining budget, so that time paused at breakpoints during the
+// RPC does not count against it
+func (s *Session) extend(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return detach(ctx, deadline.Add(s.remaining()))
+}
+
+// detach makes a context with values from ctx, and a new deadline,
+// which is cancelled when ctx is cancelled but not when ctx times out
+func detach(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	stop := context.AfterFunc(ctx, func() {
+		if ctx.Err() == context.Canceled {
+			cancel()
+		}
+	})
+	return detached, func() {
+		stop()
+		cancel()
+	}
+}
+
+// keepAlive sends 102 Processing to the client every keepAliveInterval
+// until the returned func is called, which waits for it to stop. It is
+// only used while the real reply has not been started.
+func keepAlive(w http.ResponseWriter) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// a 1xx goes out as soon as it is written, flushing
+				// would commit the real reply's status
+				w.WriteHeader(http.StatusProcessing)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,191 @@
+package rpcdb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBudget(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		value   string
+		expires time.Time
+		want    time.Duration
+	}{
+		{"30", time.Time{}, 30 * time.Second},
+		{"5m", time.Time{}, 5 * time.Minute},
+		{"", time.Time{}, DefaultBudget},
+		{"", now.Add(time.Minute), time.Minute},
+		{"3600", now.Add(time.Minute), time.Minute},
+		{"30", now.Add(-time.Minute), 0},
+	} {
+		if got := parseBudget(c.value, c.expires, now); got != c.want {
+			t.Errorf("parseBudget('%s', %s) = %s, expected %s", c.value, c.expires, got, c.want)
+		}
+	}
+}
+
+func TestExtendDeadline(t *testing.T) {
+	session := &Session{Budget: time.Hour}
+
+	parent, cancelParent := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelParent()
+	ctx, cancel := session.extend(parent)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+	if time.Until(deadline) < 59*time.Minute {
+		t.Errorf("expected deadline extended by the budget, got %s", deadline)
+	}
+	<-parent.Done()
+	time.Sleep(10 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Errorf("expected extended context to outlive its parent's deadline, got %s", ctx.Err())
+	}
+
+	parent, cancelParent = context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel = session.extend(parent)
+	defer cancel()
+	cancelParent()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("expected extended context to be cancelled with its parent")
+	}
+}
+
+func TestPauseCountsAgainstBudget(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"delay","delay_ms":20}`)
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", ds.URL)
+	h.Add("Debug-Breakpoint", "request example:/")
+	h.Add("Debug-Budget", "60")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+
+	var seen http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer ts.Close()
+
+	// a client timeout shorter than the pause is extended by the budget
+	hc := &http.Client{Timeout: 10 * time.Millisecond}
+	_, err := NewClient(hc).Calling(Identity{Service: "example"}).Get(AttachSession(context.Background(), session), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("expected pause not to time out the client, got %s", err)
+	}
+	if session.remaining() >= time.Minute {
+		t.Errorf("expected pause to use up some budget, %s left", session.remaining())
+	}
+	if left, err := time.ParseDuration(seen.Get("Debug-Budget")); err != nil || left >= time.Minute || left < 59*time.Second {
+		t.Errorf("expected remaining budget to propagate, got '%s'", seen.Get("Debug-Budget"))
+	}
+}
+
+func TestNoBudgetLeft(t *testing.T) {
+	ts := httptest.NewUnstartedServer(NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, []byte("hello")}))
+	ts.Config.ReadTimeout = time.Second
+	ts.Config.WriteTimeout = time.Second
+	ts.Start()
+	defer ts.Close()
+
+	for _, budget := range []string{"0", "0ms"} {
+		req := debugRequest(t, "http://rpcdbd.invalid/abc", "receive other:/hello")
+		req.URL.Host = ts.Listener.Addr().String()
+		req.Header.Set("Debug-Budget", budget)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected a request with Debug-Budget %s to be served, got %s", budget, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("expected 200 with Debug-Budget %s, got %d", budget, resp.StatusCode)
+		}
+	}
+}
+
+func TestKeepAliveWhilePaused(t *testing.T) {
+	defer func(d time.Duration) { keepAliveInterval = d }(keepAliveInterval)
+	keepAliveInterval = 10 * time.Millisecond
+
+	ds := debugger(`{"version":1,"action":"delay","delay_ms":100}`)
+	defer ds.Close()
+
+	// not 200, which a keep-alive could commit the reply to by mistake
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, Stub{201, []byte("hello")}))
+	defer ts.Close()
+
+	req := debugRequest(t, ds.URL, "receive example:/hello")
+	req.URL.Host = ts.Listener.Addr().String()
+	req.RequestURI = ""
+
+	processing := 0
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusProcessing {
+				processing++
+			}
+			return nil
+		},
+	}))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 || processing == 0 {
+		t.Errorf("expected 102 keep-alives before the %d reply, got %d", resp.StatusCode, processing)
+	}
+}
+
+func TestKeepAliveWhileReplyPaused(t *testing.T) {
+	defer func(d time.Duration) { keepAliveInterval = d }(keepAliveInterval)
+	keepAliveInterval = time.Millisecond
+
+	ds := debugger(`{"version":1,"action":"delay","delay_ms":50}`)
+	defer ds.Close()
+
+	big := bytes.Repeat([]byte("x"), 8<<20)
+	var logged bytes.Buffer
+	ts := httptest.NewUnstartedServer(NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, big}, WithBodyLimit(0)))
+	ts.Config.ErrorLog = log.New(&logged, "", 0)
+	ts.Start()
+	defer ts.Close()
+
+	processing := 0
+	req := debugGet(t, ts.URL, ds.URL, "reply example:/hello")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusProcessing {
+				processing++
+			}
+			return nil
+		},
+	}))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !bytes.Equal(body, big) || processing == 0 {
+		t.Errorf("expected 102 keep-alives before the whole %d reply, got %d bytes and %d", resp.StatusCode, len(body), processing)
+	}
+	if strings.Contains(logged.String(), "superfluous") {
+		t.Errorf("expected keep-alives to stop before the reply, got %s", logged.String())
+	}
+}
@@ -0,0 +1,28 @@
+package rpcdb
+
+import (
+	"context"
+	"net/http"
+)
+
+// calleeKey is the context key for the service an outbound request is
+// addressed to
+type calleeKey struct{}
+
+// WithCallee returns a copy of ctx which names the service that
+// requests made with it are addressed to. Request and response
+// breakpoints match against the callee, so this is what makes
+// `request billing:/charge` trigger on calls to billing.
+func WithCallee(ctx context.Context, callee Identity) context.Context {
+	return context.WithValue(ctx, calleeKey{}, callee)
+}
+
+// Callee identifies the service req is addressed to. This is the
+// identity given to WithCallee on the request's context if there is
+// one, otherwise a service named for the host being called.
+func Callee(req *http.Request) Identity {
+	if id, ok := req.Context().Value(calleeKey{}).(Identity); ok {
+		return id
+	}
+	return Identity{Service: req.URL.Hostname()}
+}
@@ -0,0 +1,73 @@
+package rpcdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCallee(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://billing.internal:8080/charge", nil)
+	if got := Callee(req); got != (Identity{Service: "billing.internal"}) {
+		t.Errorf("expected callee named for the host, got %v", got)
+	}
+
+	billing := Identity{Region: "us-west-2", Service: "billing"}
+	req = req.WithContext(WithCallee(context.Background(), billing))
+	if got := Callee(req); got != billing {
+		t.Errorf("expected callee from context, got %v", got)
+	}
+}
+
+func TestTransportCallee(t *testing.T) {
+	tr := &Transport{
+		Hosts:  map[string]Identity{"a.internal:8080": {Service: "a"}, "b.internal": {Service: "b"}},
+		Callee: Identity{Service: "default"},
+	}
+	for rawurl, want := range map[string]string{
+		"http://a.internal:8080/": "a",
+		"http://b.internal:9090/": "b",
+		"http://c.internal/":      "default",
+	} {
+		u, _ := url.Parse(rawurl)
+		got, ok := tr.callee(&http.Request{URL: u})
+		if !ok || got.Service != want {
+			t.Errorf("expected %s to resolve to %s, got %v", rawurl, want, got)
+		}
+	}
+}
+
+func TestRequestBreakpointMatchesCallee(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", ds.URL)
+	h.Add("Debug-Breakpoint", "request billing:/charge")
+	session, _ := BuildSession(Identity{Service: "frontend"}, h)
+	ctx := AttachSession(context.Background(), session)
+	c := NewClient(http.DefaultClient)
+
+	if _, err := c.Get(ctx, ts.URL+"/charge"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(events()) != 0 {
+		t.Fatalf("expected no break on a call to another service, got %v", events())
+	}
+
+	if _, err := c.Get(WithCallee(ctx, Identity{Service: "billing"}), ts.URL+"/charge"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(events()) != 1 {
+		t.Fatalf("expected a break on the call to billing, got %d events", len(events()))
+	}
+	ev := events()[0]
+	if ev.Caller == nil || ev.Caller.Service != "frontend" || ev.Callee.Service != "billing" {
+		t.Errorf("expected caller frontend and callee billing, got %v and %v", ev.Caller, ev.Callee)
+	}
+}
@@ -0,0 +1,272 @@
+package rpcdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errReplyEnded is returned to a handler writing a streamed reply
+// which the debugger has ended
+var errReplyEnded = errors.New("reply ended by debugger")
+
+// captureWriter holds on to a handler's reply so that it can go to the
+// debugger before being sent. It keeps the optional interfaces of the
+// real writer a handler may rely on:
+//
+//	http.Flusher        the reply becomes a stream, each flushed chunk
+//	                    goes through the reply hook on its own, see
+//	                    ReplyTrap
+//	http.Hijacker       the connection is handed over and the reply
+//	                    hook is skipped, as for a WebSocket
+//	http.CloseNotifier  passed through to the real writer
+//
+// and unwraps to the real writer for http.ResponseController.
+//
+// No more than limit bytes are held in memory, and those count against
+// the middleware's buffer limit through reserve. Past either the rest
+// is spooled to a temporary file, or else what is held goes through
+// the reply hook marked truncated, and the rest passes straight on to
+// the client.
+type captureWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	snapshot    http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+
+	limit    int64
+	spool    bool
+	spoolDir string
+	overflow *os.File
+	spooled  int64
+
+	// reserve and unreserve count the held bytes in memory against
+	// the middleware's buffer limit
+	reserve   func(n int64) bool
+	unreserve func(n int64)
+	held      int64
+
+	// streaming is set once the handler flushes, after which flush
+	// sends each chunk, numbered by chunks, through the reply hook.
+	// finishing is set for the last, once the handler is done.
+	// truncated is set when the reply went over the limit, after
+	// which passing is set and it goes straight to the real writer.
+	streaming bool
+	chunks    int
+	finishing bool
+	truncated bool
+	passing   bool
+	flush     func(chunk *payload) error
+	err       error
+	ended     bool
+	hijacked  bool
+}
+
+func newCaptureWriter(w http.ResponseWriter) *captureWriter {
+	return &captureWriter{w: w, header: http.Header{}, status: http.StatusOK}
+}
+
+func (c *captureWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 {
+		// informational replies, such as 103 Early Hints, go straight out
+		for k, vs := range c.header {
+			c.w.Header()[k] = vs
+		}
+		c.w.WriteHeader(status)
+		return
+	}
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	c.status = status
+	c.snapshot = c.header.Clone()
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.ended {
+		return 0, errReplyEnded
+	}
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.passing {
+		return c.w.Write(b)
+	}
+	if c.overflow != nil {
+		n, err := c.overflow.Write(b)
+		c.spooled += int64(n)
+		return n, err
+	}
+	room := c.limit - int64(c.body.Len())
+	if c.limit <= 0 || int64(len(b)) <= room {
+		room = int64(len(b))
+	}
+	if !c.hold(room) {
+		room = 0
+	}
+	if room == int64(len(b)) {
+		return c.body.Write(b)
+	}
+
+	c.body.Write(b[:room])
+	if c.spool {
+		// failing to spool falls back to truncating
+		if f, err := ioutil.TempFile(c.spoolDir, "rpcdb-body-"); err == nil {
+			c.overflow = f
+			n, err := c.overflow.Write(b[room:])
+			c.spooled += int64(n)
+			return int(room) + n, err
+		}
+	}
+	c.truncated = true
+	c.streaming = true
+	c.sendChunk()
+	if c.ended {
+		return int(room), errReplyEnded
+	}
+	c.passing = true
+	n, err := c.w.Write(b[room:])
+	return int(room) + n, err
+}
+
+// hold reserves n more bytes to be held in memory, if that fits
+func (c *captureWriter) hold(n int64) bool {
+	if c.reserve != nil && !c.reserve(n) {
+		return false
+	}
+	c.held += n
+	return true
+}
+
+// release gives back the bytes held in memory
+func (c *captureWriter) release() {
+	if c.unreserve != nil {
+		c.unreserve(c.held)
+	}
+	c.held = 0
+}
+
+// Flush switches to streaming the reply, and sends what has been
+// written since the last flush on through the reply hook
+func (c *captureWriter) Flush() {
+	if c.ended || c.hijacked {
+		return
+	}
+	if c.passing {
+		http.NewResponseController(c.w).Flush()
+		return
+	}
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.streaming = true
+	c.sendChunk()
+}
+
+// sendChunk passes the buffered chunk to the reply hook
+func (c *captureWriter) sendChunk() {
+	chunk := c.payload()
+	defer c.release()
+	defer chunk.discard()
+	c.body.Reset()
+	c.overflow, c.spooled = nil, 0
+	c.chunks++
+	if err := c.flush(chunk); err != nil {
+		if err == errReplyEnded {
+			c.ended = true
+		} else if c.err == nil {
+			c.err = err
+		}
+	}
+}
+
+// payload returns what has been captured since the last chunk
+func (c *captureWriter) payload() *payload {
+	p := &payload{
+		head:      append([]byte(nil), c.body.Bytes()...),
+		truncated: c.truncated,
+		spool:     c.overflow,
+		size:      int64(c.body.Len()) + c.spooled,
+	}
+	if c.truncated {
+		p.size = -1
+		if n, err := strconv.ParseInt(c.snapshot.Get("Content-Length"), 10, 64); err == nil {
+			p.size = n
+		}
+	}
+	return p
+}
+
+// discard removes the spool file of a reply which was never sent, and
+// gives back what was held in memory
+func (c *captureWriter) discard() {
+	c.release()
+	if c.overflow != nil {
+		c.overflow.Close()
+		os.Remove(c.overflow.Name())
+		c.overflow = nil
+	}
+}
+
+func (c *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := c.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (c *captureWriter) CloseNotify() <-chan bool {
+	if cn, ok := c.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.w
+}
+
+// captured returns the reply's headers as they were when the handler
+// started it, and the trailers set afterwards
+func (c *captureWriter) captured() (header, trailer http.Header) {
+	header = c.snapshot
+	if header == nil {
+		header = c.header.Clone()
+	}
+	trailer = http.Header{}
+	for _, declared := range header["Trailer"] {
+		for _, k := range strings.Split(declared, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vs, ok := c.header[k]; ok {
+				trailer[k] = vs
+			}
+		}
+	}
+	for k, vs := range c.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(k[len(http.TrailerPrefix):])] = vs
+		}
+	}
+	if len(trailer) == 0 {
+		trailer = nil
+	}
+	return header, trailer
+}
@@ -0,0 +1,148 @@
+package rpcdb
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureWriterInterfaces(t *testing.T) {
+	ds, _ := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher := w.(http.Flusher)
+		_, hijacker := w.(http.Hijacker)
+		_, notifier := w.(http.CloseNotifier)
+		if !flusher || !hijacker || !notifier {
+			t.Errorf("expected capture writer to be a Flusher %t, Hijacker %t and CloseNotifier %t", flusher, hijacker, notifier)
+		}
+		w.Write([]byte("hello"))
+	})))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Do(debugGet(t, ts.URL, ds.URL, "reply example:/hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+}
+
+func TestReplyServerSentEvents(t *testing.T) {
+	ds, events := recordingDebugger(func(ev Event) string {
+		if ev.Chunk == 2 {
+			return `{"version":1,"action":"modify","body":{"data":"data: changed\n\n"}}`
+		}
+		return `{"version":1}`
+	})
+	defer ds.Close()
+
+	next := make(chan struct{})
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		// the client must get the first event before there is a second
+		<-next
+		w.Write([]byte("data: two\n\n"))
+		w.(http.Flusher).Flush()
+	})))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Do(debugGet(t, ts.URL, ds.URL, "reply example:/hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected the handler's headers, got %v", resp.Header)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	first, _ := reader.ReadString('\n')
+	if first != "data: one\n" {
+		t.Errorf("unexpected first event '%s'", first)
+	}
+	close(next)
+
+	rest, _ := ioutil.ReadAll(reader)
+	if string(rest) != "\ndata: changed\n\n" {
+		t.Errorf("expected the second event to be modified, got '%s'", rest)
+	}
+
+	seen := events()
+	if len(seen) != 2 || seen[0].Chunk != 1 || seen[0].Body.Data != "data: one\n\n" || seen[1].Chunk != 2 {
+		t.Errorf("expected an event per chunk, got %v", seen)
+	}
+}
+
+func TestReplyStreamAbort(t *testing.T) {
+	ds, _ := recordingDebugger(func(ev Event) string {
+		if ev.Chunk == 2 {
+			return `{"version":1,"action":"abort"}`
+		}
+		return `{"version":1}`
+	})
+	defer ds.Close()
+
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range []string{"one ", "two ", "three"} {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	})))
+	defer ts.Close()
+
+	resp, err := http.DefaultClient.Do(debugGet(t, ts.URL, ds.URL, "reply example:/hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil || string(body) != "one " {
+		t.Errorf("expected the stream to be cut off after the first chunk, got '%s' %v", body, err)
+	}
+}
+
+func TestReplyHijackPassesThrough(t *testing.T) {
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unable to hijack: %s", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhijacked")
+		rw.Flush()
+	})))
+	defer ts.Close()
+
+	for _, upgrade := range []bool{true, false} {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("unable to connect: %s", err)
+		}
+		req := debugGet(t, "http://"+ts.Listener.Addr().String(), ds.URL, "reply example:/hello")
+		if upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "echo")
+		}
+		req.Write(conn)
+		raw, _ := io.ReadAll(conn)
+		conn.Close()
+		if !strings.HasPrefix(string(raw), "HTTP/1.1 101") || !strings.HasSuffix(string(raw), "hijacked") {
+			t.Errorf("expected the hijacked connection to be passed through, got '%s'", raw)
+		}
+	}
+	if len(events()) != 0 {
+		t.Errorf("expected no reply events for hijacked connections, got %v", events())
+	}
+}
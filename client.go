@@ -1,68 +1,88 @@
 package rpcdb
 
 import (
+	"context"
 	"fmt"
-	"golang.org/x/net/context"
 	"io"
 	"net/http"
+	"net/url"
 )
 
-// TODO use proper ctxhttp package
-// 		need this to fiddle timeouts properly
-// TODO refactor client to use arbitrary interceptors, with debug as an interceptor
-// TODO move ^^ generic client into its own package
+// TODO move the generic client into its own package
 
-const sessionKey = "github.com/brianm/rpcdb:debug_session_key"
+// sessionKey is the context key for the debug session
+type sessionKey struct{}
 
-func AttachSession(ctx context.Context, session Session) context.Context {
-	return context.WithValue(ctx, sessionKey, session)
+// AttachSession returns a copy of ctx carrying session. The middleware
+// does this for the handler's request context, so that requests made
+// with it continue the session.
+func AttachSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
 }
 
-func ExtractSession(ctx context.Context) (Session, bool) {
-	s, ok := ctx.Value(sessionKey).(Session)
-	return s, ok
+// ExtractSession finds the debug session on ctx, if there is one
+func ExtractSession(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	return s, ok && s != nil
 }
 
+// DebugClient is an http.Client which runs the request and response
+// hooks for the session attached to each request's context, see
+// Transport.
 type DebugClient struct {
 	http *http.Client
 }
 
-func NewClient(hc *http.Client) DebugClient {
-	return DebugClient{hc}
+// NewClient builds a DebugClient making requests the way hc does, with
+// hooks configured by opts, see NewTransport
+func NewClient(hc *http.Client, opts ...Option) DebugClient {
+	debugging := *hc
+	debugging.Transport = NewTransport(hc.Transport, opts...)
+	return DebugClient{&debugging}
 }
 
-func (c DebugClient) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
-	session, ok := ExtractSession(ctx)
+// Calling returns a copy of the client whose requests are all
+// addressed to callee, for request and response breakpoints
+func (c DebugClient) Calling(callee Identity) DebugClient {
+	debugging := *c.http
+	t := *debugging.Transport.(*Transport)
+	t.Callee = callee
+	debugging.Transport = &t
+	return DebugClient{&debugging}
+}
 
-	newReq, err := session.Request(req)
-	if err != nil {
-		return nil, err
+// Do sends req, debugging it if req.Context() carries a session. The
+// client's Timeout is extended by what is left of the session's budget.
+func (c DebugClient) Do(req *http.Request) (*http.Response, error) {
+	hc := c.http
+	if session, ok := ExtractSession(req.Context()); ok && hc.Timeout > 0 {
+		extended := *hc
+		extended.Timeout += session.remaining()
+		hc = &extended
 	}
 
-	resp, err := c.http.Do(newReq)
-	if err != nil {
-		return resp, err
-	}
-	if ok {
-		return session.Response(req, resp)
-	} else {
-		return resp, nil
+	resp, err := hc.Do(req)
+	if uerr, ok := err.(*url.Error); ok {
+		if halt, isHalt := uerr.Err.(*Halt); isHalt {
+			return resp, halt
+		}
 	}
+	return resp, err
 }
 
 func (c DebugClient) Get(ctx context.Context, url string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create request: %s", err)
 	}
-	return c.Do(ctx, req)
+	return c.Do(req)
 }
 
 func (c DebugClient) Post(ctx context.Context, url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return nil, fmt.Errorf("unable to make request: %s", err)
 	}
 	req.Header.Add("Content-Type", bodyType)
-	return c.Do(ctx, req)
+	return c.Do(req)
 }
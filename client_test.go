@@ -1,9 +1,9 @@
 package rpcdb
 
 import (
+	"context"
 	"fmt"
 	"github.com/alioygur/gores"
-	"golang.org/x/net/context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -15,14 +15,14 @@ func TestDebugContext(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	req.Header.Add("debug-breakpoint", "request example:*")
 	req.Header.Add("debug-session", "http://example/123")
-	session, _ := BuildSession("example", req.Header)
+	session, _ := BuildSession(Identity{Service: "example"}, req.Header)
 
 	ctx := AttachSession(context.Background(), session)
 	session, ok := ExtractSession(ctx)
 	if !ok {
 		t.Errorf("session not found on context!")
 	}
-	if session.Name != "example" {
+	if session.Identity.Service != "example" {
 		t.Errorf("wrong name!")
 	}
 }
@@ -36,8 +36,10 @@ func TestResponseHook(t *testing.T) {
 
 	// debug server transforming body
 	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gores.JSON(w, 200, ResponseBody{
-			Body: "TRANSFORMED",
+		gores.JSON(w, 200, Verdict{
+			Version: ProtocolVersion,
+			Action:  ActionModify,
+			Body:    &Body{Encoding: "text", Data: "TRANSFORMED"},
 		})
 	}))
 	defer ds.Close()
@@ -48,9 +50,9 @@ func TestResponseHook(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	req.Header.Add("debug-breakpoint", "response example:/")
 	req.Header.Add("debug-session", ds.URL)
-	session, _ := BuildSession("example", req.Header)
+	session, _ := BuildSession(Identity{Service: "example"}, req.Header)
 
-	c := NewClient(http.DefaultClient)
+	c := NewClient(http.DefaultClient).Calling(Identity{Service: "example"})
 
 	ctx := AttachSession(context.Background(), session)
 	r, err := c.Get(ctx, fmt.Sprintf("%s/", ts.URL))
@@ -76,8 +78,10 @@ func TestRequestHook(t *testing.T) {
 
 	// debug server transforming body
 	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gores.JSON(w, 200, RequestBody{
-			Body: "TRANSFORMED",
+		gores.JSON(w, 200, Verdict{
+			Version: ProtocolVersion,
+			Action:  ActionModify,
+			Body:    &Body{Encoding: "text", Data: "TRANSFORMED"},
 		})
 	}))
 	defer ds.Close()
@@ -87,9 +91,9 @@ func TestRequestHook(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	req.Header.Add("debug-breakpoint", "request example:/")
 	req.Header.Add("debug-session", ds.URL)
-	session, _ := BuildSession("example", req.Header)
+	session, _ := BuildSession(Identity{Service: "example"}, req.Header)
 
-	c := NewClient(http.DefaultClient)
+	c := NewClient(http.DefaultClient).Calling(Identity{Service: "example"})
 
 	ctx := AttachSession(context.Background(), session)
 	r, err := c.Post(ctx, fmt.Sprintf("%s/", ts.URL), "text/plain", strings.NewReader("hello world"))
@@ -103,3 +107,60 @@ func TestRequestHook(t *testing.T) {
 		t.Errorf("expected body to be TRANSFORMED, it was '%s'", body)
 	}
 }
+
+func TestClientHonorsContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gores.String(w, 200, "hello world")
+	}))
+	defer ts.Close()
+
+	h := http.Header{}
+	h.Add("debug-breakpoint", "request other:/")
+	h.Add("debug-session", "http://example/123")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+
+	ctx, cancel := context.WithCancel(AttachSession(context.Background(), session))
+	cancel()
+
+	if _, err := NewClient(http.DefaultClient).Calling(Identity{Service: "example"}).Get(ctx, ts.URL+"/"); err == nil {
+		t.Error("expected a cancelled context to fail the request")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	var seen http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+		gores.String(w, 200, "hello world")
+	}))
+	defer ts.Close()
+
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("debug-breakpoint", "request example:/")
+	h.Add("debug-session", ds.URL)
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+	ctx := AttachSession(context.Background(), session)
+
+	c := NewClient(http.DefaultClient, WithBodyLimit(5)).Calling(Identity{Service: "example"})
+	r, err := c.Post(ctx, ts.URL+"/", "text/plain", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("error issuing request: %s", err)
+	}
+	r.Body.Close()
+	if got := events(); len(got) != 1 || !got[0].Body.Truncated {
+		t.Errorf("expected the client's body limit to truncate the event, got %+v", got)
+	}
+
+	c = NewClient(http.DefaultClient, WithAllowedSessions("https://debugger.example")).Calling(Identity{Service: "example"})
+	r, err = c.Post(ctx, ts.URL+"/", "text/plain", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("error issuing request: %s", err)
+	}
+	r.Body.Close()
+	if len(events()) != 1 || seen.Get("Debug-Session") != "" {
+		t.Errorf("expected a session the client does not allow to be left alone, got %+v and %v", events(), seen)
+	}
+}
@@ -0,0 +1,318 @@
+package rpcdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Condition is a single predicate from the `if` clause of a
+// breakpoint expression, such as `method == POST`,
+// `header.Content-Type =~ "json$"` or `$.order.amount > 1000`.
+//
+// Subjects are `method`, `status` (reply and response hooks only),
+// `header.<name>`, `query.<name>`, and JSONPath style expressions on a
+// JSON body beginning with `$`. Operators are `==`, `!=`, `=~` and
+// `!~` (regular expression match), and the numeric comparisons `>`,
+// `>=`, `<`, and `<=`. Values are either a bare word or a double
+// quoted string.
+type Condition struct {
+	Subject string
+	Key     string
+	Op      string
+	Value   string
+	re      *regexp.Regexp
+}
+
+// Conditions must all hold for a breakpoint to trigger
+type Conditions []Condition
+
+// message is the view of a request or response which conditions are
+// evaluated against. status is zero for requests. callee is the
+// service the request is addressed to, or that sent the response.
+// trailer is only set for replies and responses, and chunk numbers
+// the pieces of a streamed reply.
+type message struct {
+	method  string
+	url     *url.URL
+	header  http.Header
+	status  int
+	body    []byte
+	callee  Identity
+	trailer http.Header
+	chunk   int
+
+	// payload is the body as captured, when it may be over the limit,
+	// in which case body is only its start
+	payload *payload
+}
+
+var operators = []string{"==", "!=", "=~", "!~", ">=", "<=", ">", "<"}
+
+// ParseConditions parses the `if` clause of a breakpoint expression,
+// which is one or more conditions joined by `&&`
+func ParseConditions(clause string) (Conditions, error) {
+	conds := Conditions{}
+	rest := strings.TrimSpace(clause)
+	for {
+		cond, remaining, err := parseCondition(rest)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+
+		remaining = strings.TrimSpace(remaining)
+		if remaining == "" {
+			return conds, nil
+		}
+		if !strings.HasPrefix(remaining, "&&") {
+			return nil, fmt.Errorf("expected '&&' in condition at '%s'", remaining)
+		}
+		rest = strings.TrimSpace(remaining[2:])
+	}
+}
+
+// parseCondition parses one condition from the front of s, returning
+// whatever follows it
+func parseCondition(s string) (Condition, string, error) {
+	c := Condition{}
+
+	end := strings.IndexAny(s, " \t=!<>")
+	if end <= 0 {
+		return c, "", fmt.Errorf("malformed condition '%s'", s)
+	}
+	subject := s[:end]
+	s = strings.TrimSpace(s[end:])
+
+	switch {
+	case subject == "method" || subject == "status":
+		c.Subject = subject
+	case strings.HasPrefix(subject, "header."):
+		c.Subject, c.Key = "header", http.CanonicalHeaderKey(subject[len("header."):])
+	case strings.HasPrefix(subject, "query."):
+		c.Subject, c.Key = "query", subject[len("query."):]
+	case strings.HasPrefix(subject, "$"):
+		c.Subject, c.Key = "body", subject
+		if _, err := parseJSONPath(subject); err != nil {
+			return c, "", err
+		}
+	default:
+		return c, "", fmt.Errorf("unknown condition subject '%s'", subject)
+	}
+	if (c.Subject == "header" || c.Subject == "query") && c.Key == "" {
+		return c, "", fmt.Errorf("condition subject '%s' needs a name", subject)
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			c.Op = op
+			break
+		}
+	}
+	if c.Op == "" {
+		return c, "", fmt.Errorf("expected operator after '%s'", subject)
+	}
+	s = strings.TrimSpace(s[len(c.Op):])
+
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return c, "", fmt.Errorf("malformed quoted value in condition at '%s'", s)
+		}
+		c.Value, _ = strconv.Unquote(quoted)
+		s = s[len(quoted):]
+	} else {
+		end = strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		if end == 0 {
+			return c, "", fmt.Errorf("missing value for condition on '%s'", subject)
+		}
+		c.Value, s = s[:end], s[end:]
+	}
+
+	switch c.Op {
+	case "=~", "!~":
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return c, "", fmt.Errorf("bad regular expression in condition: %s", err)
+		}
+		c.re = re
+	case ">", ">=", "<", "<=":
+		if _, err := strconv.ParseFloat(c.Value, 64); err != nil {
+			return c, "", fmt.Errorf("'%s' needs a numeric value, got '%s'", c.Op, c.Value)
+		}
+	}
+	return c, s, nil
+}
+
+// eval reports whether all of the conditions hold for m
+func (cs Conditions) eval(m message) bool {
+	for _, c := range cs {
+		if !c.eval(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Condition) eval(m message) bool {
+	var actual []string
+	switch c.Subject {
+	case "method":
+		actual = []string{m.method}
+	case "status":
+		if m.status != 0 {
+			actual = []string{strconv.Itoa(m.status)}
+		}
+	case "header":
+		actual = m.header[c.Key]
+	case "query":
+		if m.url != nil {
+			actual = m.url.Query()[c.Key]
+		}
+	case "body":
+		actual = jsonPathValues(c.Key, m.body)
+	}
+
+	// negative operators hold when no value matches, including when
+	// there is no value at all
+	switch c.Op {
+	case "!=":
+		return !anyOf(actual, func(a string) bool { return equalValues(a, c.Value) })
+	case "!~":
+		return !anyOf(actual, c.re.MatchString)
+	case "==":
+		return anyOf(actual, func(a string) bool { return equalValues(a, c.Value) })
+	case "=~":
+		return anyOf(actual, c.re.MatchString)
+	}
+
+	want, _ := strconv.ParseFloat(c.Value, 64)
+	return anyOf(actual, func(a string) bool {
+		got, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return false
+		}
+		switch c.Op {
+		case ">":
+			return got > want
+		case ">=":
+			return got >= want
+		case "<":
+			return got < want
+		case "<=":
+			return got <= want
+		}
+		return false
+	})
+}
+
+func anyOf(values []string, test func(string) bool) bool {
+	for _, v := range values {
+		if test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalValues compares numerically if both sides are numbers, so that
+// `$.amount == 10` holds for a body of `{"amount": 10.0}`
+func equalValues(actual, expected string) bool {
+	a, aerr := strconv.ParseFloat(actual, 64)
+	e, eerr := strconv.ParseFloat(expected, 64)
+	if aerr == nil && eerr == nil {
+		return a == e
+	}
+	return actual == expected
+}
+
+// parseJSONPath breaks a JSONPath style expression, such as
+// `$.items[0].price`, into object keys (strings) and array indexes
+// (ints)
+func parseJSONPath(expr string) ([]interface{}, error) {
+	steps := []interface{}{}
+	rest := strings.TrimPrefix(expr, "$")
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in json path '%s'", expr)
+			}
+			steps = append(steps, rest[1:end+1])
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in json path '%s'", expr)
+			}
+			idx, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("bad index in json path '%s'", expr)
+			}
+			steps = append(steps, idx)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("malformed json path '%s'", expr)
+		}
+	}
+	return steps, nil
+}
+
+// jsonPathValues finds the value at expr in a JSON body, rendered as
+// a string for comparison. Scalars are rendered bare, objects and
+// arrays as JSON. A body which is not JSON, or has nothing at expr,
+// has no values.
+func jsonPathValues(expr string, body []byte) []string {
+	steps, err := parseJSONPath(expr)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			if v, ok = obj[s]; !ok {
+				return nil
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || s < 0 || s >= len(arr) {
+				return nil
+			}
+			v = arr[s]
+		}
+	}
+
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case float64:
+		return []string{strconv.FormatFloat(val, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(val)}
+	case nil:
+		return []string{"null"}
+	default:
+		encoded, _ := json.Marshal(val)
+		return []string{string(encoded)}
+	}
+}
@@ -0,0 +1,102 @@
+package rpcdb
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseConditionalExpr(t *testing.T) {
+	bp, err := ParseExpression(`receive billing:/charge if method == POST && $.amount > 1000`)
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if bp.RPCName != "/charge" {
+		t.Errorf("expected rpc=/charge, got %s", bp.RPCName)
+	}
+	if len(bp.Conditions) != 2 {
+		t.Fatalf("expected 2 conditions, got %v", bp.Conditions)
+	}
+	if c := bp.Conditions[0]; c.Subject != "method" || c.Op != "==" || c.Value != "POST" {
+		t.Errorf("unexpected first condition %+v", c)
+	}
+	if c := bp.Conditions[1]; c.Subject != "body" || c.Key != "$.amount" || c.Op != ">" || c.Value != "1000" {
+		t.Errorf("unexpected second condition %+v", c)
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	for _, expr := range []string{
+		`receive example:/ if`,
+		`receive example:/ if method`,
+		`receive example:/ if method ==`,
+		`receive example:/ if wombat == 1`,
+		`receive example:/ if header. == 1`,
+		`receive example:/ if $.a > big`,
+		`receive example:/ if header.Accept =~ "("`,
+		`receive example:/ if method == GET method == POST`,
+		`receive example:/ if $.a[x] == 1`,
+		`receive example:/ if status == 200`,
+		`request example:/ if status == 200`,
+	} {
+		if _, err := ParseExpression(expr); err == nil {
+			t.Errorf("expected '%s' to fail to parse", expr)
+		}
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	u, _ := url.Parse("http://example.com/charge?currency=usd&dry_run=1")
+	msg := message{
+		method: "POST",
+		url:    u,
+		header: http.Header{"Content-Type": {"application/json; charset=utf-8"}, "X-Tenant": {"acme"}},
+		status: 502,
+		body:   []byte(`{"amount": 1500.0, "items": [{"sku": "abc"}], "gift": false, "note": "hello world"}`),
+	}
+
+	cases := []struct {
+		clause string
+		holds  bool
+	}{
+		{`method == POST`, true},
+		{`method != POST`, false},
+		{`method == GET`, false},
+		{`header.content-type =~ "^application/json"`, true},
+		{`header.X-Tenant == acme`, true},
+		{`header.X-Tenant != acme`, false},
+		{`header.X-Missing == acme`, false},
+		{`header.X-Missing != acme`, true},
+		{`query.currency == usd`, true},
+		{`query.currency !~ "^eu"`, true},
+		{`status >= 500`, true},
+		{`status < 500`, false},
+		{`$.amount > 1000`, true},
+		{`$.amount == 1500`, true},
+		{`$.amount <= 1000`, false},
+		{`$.items[0].sku == abc`, true},
+		{`$.items[1].sku == abc`, false},
+		{`$.gift == false`, true},
+		{`$.note == "hello world"`, true},
+		{`method == POST && $.amount > 1000 && query.dry_run == 1`, true},
+		{`method == POST && $.amount > 2000`, false},
+	}
+
+	for _, c := range cases {
+		conds, err := ParseConditions(c.clause)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %s", c.clause, err)
+			continue
+		}
+		if conds.eval(msg) != c.holds {
+			t.Errorf("expected '%s' to be %v", c.clause, c.holds)
+		}
+	}
+}
+
+func TestBodyConditionOnNonJSON(t *testing.T) {
+	conds, _ := ParseConditions(`$.amount > 1`)
+	if conds.eval(message{body: []byte("amount=2")}) {
+		t.Error("expected json condition on a non-json body to not hold")
+	}
+}
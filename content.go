@@ -0,0 +1,190 @@
+package rpcdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// maxDecodedBody bounds undoing a Content-Encoding when bodies have no
+// limit, as a small compressed body can decode to any size
+const maxDecodedBody = 16 << 20
+
+// rawDeflate is the deflate Content-Encoding without the zlib wrapping
+// it is meant to have, which some peers send. Bodies are encoded again
+// with whichever they were sent with.
+const rawDeflate = "deflate (raw)"
+
+// Part is one part of a multipart body
+type Part struct {
+	Header http.Header `json:"header"`
+	Body   Body        `json:"body"`
+}
+
+// inspect makes an event's body, raw, easier for the debugger to read,
+// given the message's header. A body with a Content-Encoding it knows
+// is sent decoded, with ContentEncoding set, as long as that comes to
+// no more than limit bytes, and reserve lets it hold them. Form and
+// multipart bodies have their fields broken out in Form and Parts as
+// well. Anything which fails to decode is sent as it is. It returns
+// how many bytes it got from reserve, to be given back once the event
+// has been sent.
+func (b *Body) inspect(header http.Header, raw []byte, limit int64, reserve func(int64) bool) (held int64) {
+	if ce := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))); ce != "" {
+		decoded, err := decodeContent(ce, raw, limit)
+		if err != nil || !reserve(int64(len(decoded))) {
+			return 0
+		}
+		held = int64(len(decoded))
+		*b = NewBody(decoded)
+		b.ContentType = header.Get("Content-Type")
+		b.ContentEncoding = ce
+		b.rawDeflate = ce == "deflate" && isRawDeflate(raw)
+		raw = decoded
+	}
+
+	mediaType, params, err := mime.ParseMediaType(b.ContentType)
+	if err != nil {
+		return held
+	}
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		if form, err := url.ParseQuery(string(raw)); err == nil {
+			b.Form = form
+		}
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		if parts, err := readParts(raw, params["boundary"]); err == nil {
+			b.Parts = parts
+		}
+	}
+	return held
+}
+
+// readParts breaks a multipart body out into its parts
+func readParts(raw []byte, boundary string) ([]Part, error) {
+	parts := []Part{}
+	r := multipart.NewReader(bytes.NewReader(raw), boundary)
+	for {
+		p, err := r.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, Part{Header: http.Header(p.Header), Body: NewBody(data)})
+	}
+}
+
+// writeParts encodes parts as a multipart body with the boundary given
+// by contentType
+func writeParts(parts []Part, contentType string) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return nil, errors.New("multipart body needs a content_type with a boundary")
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(params["boundary"]); err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		data, err := part.Body.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		pw, err := w.CreatePart(textproto.MIMEHeader(part.Header))
+		if err != nil {
+			return nil, err
+		}
+		pw.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeContent undoes a Content-Encoding, or rawDeflate, failing if the result is
+// over limit bytes, or maxDecodedBody if limit is zero or less
+func decodeContent(encoding string, raw []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but is often sent raw
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(raw))
+		} else {
+			r = zr
+		}
+	case rawDeflate:
+		r = flate.NewReader(bytes.NewReader(raw))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(raw))
+	default:
+		return nil, fmt.Errorf("unknown content encoding '%s'", encoding)
+	}
+	if limit <= 0 {
+		limit = maxDecodedBody
+	}
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(decoded)) > limit {
+		err = fmt.Errorf("decoded body is over %d bytes", limit)
+	}
+	return decoded, err
+}
+
+// isRawDeflate reports whether a deflate body lacks the zlib wrapping
+func isRawDeflate(raw []byte) bool {
+	_, err := zlib.NewReader(bytes.NewReader(raw))
+	return err != nil
+}
+
+// encodeContent applies a Content-Encoding, or rawDeflate
+func encodeContent(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case rawDeflate:
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unknown content encoding '%s'", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
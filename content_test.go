@@ -0,0 +1,192 @@
+package rpcdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestContentEncodingRoundTrip(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", rawDeflate, "br"} {
+		encoded, err := encodeContent(encoding, []byte("hello world"))
+		if err != nil {
+			t.Fatalf("unable to %s: %s", encoding, err)
+		}
+		decoded, err := decodeContent(encoding, encoded, 0)
+		if err != nil || string(decoded) != "hello world" {
+			t.Errorf("expected %s to round trip, got '%s' %v", encoding, decoded, err)
+		}
+		if _, err := decodeContent(encoding, encoded, 5); err == nil {
+			t.Errorf("expected %s over the limit to fail", encoding)
+		}
+	}
+	if _, err := decodeContent("compress", nil, 0); err == nil {
+		t.Error("expected unknown content encoding to fail")
+	}
+}
+
+// receiveVerdict serves req behind the middleware with a receive
+// breakpoint, answering with whatever verdict returns for the event
+func receiveVerdict(t *testing.T, req *http.Request, verdict func(Event) Verdict) *http.Request {
+	ds, _ := recordingDebugger(func(ev Event) string {
+		b, _ := json.Marshal(verdict(ev))
+		return string(b)
+	})
+	defer ds.Close()
+
+	var got *http.Request
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		r.ParseMultipartForm(1 << 20)
+	}))
+	m.ServeHTTP(httptest.NewRecorder(), withDebugSession(t, req, ds.URL, "receive example:/hello"))
+	if got == nil {
+		t.Fatal("expected the handler to be called")
+	}
+	return got
+}
+
+func TestReceiveGzipDecoded(t *testing.T) {
+	compressed, _ := encodeContent("gzip", []byte("hello world"))
+	req, _ := http.NewRequest("POST", "http://example.com/hello", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Length", "11")
+
+	var seen Event
+	got := receiveVerdict(t, req, func(ev Event) Verdict {
+		seen = ev
+		body := ev.Body
+		body.Data = "goodbye world"
+		return Verdict{Version: ProtocolVersion, Action: ActionModify, Body: &body}
+	})
+
+	if seen.Body.Data != "hello world" || seen.Body.ContentEncoding != "gzip" {
+		t.Errorf("expected the debugger to see the body decoded, got %+v", seen.Body)
+	}
+	sent := mustRead(t, got)
+	raw, _ := decodeContent("gzip", sent, 0)
+	if string(raw) != "goodbye world" || got.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the edited body to be gzipped again, got '%s' %v", raw, got.Header)
+	}
+	if got.ContentLength != int64(len(sent)) || got.Header.Get("Content-Length") != strconv.Itoa(len(sent)) {
+		t.Errorf("expected Content-Length to follow the new body, got %d %s", got.ContentLength, got.Header.Get("Content-Length"))
+	}
+}
+
+func TestReceiveFormDecoded(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("amount=10&to=bob"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var seen Event
+	got := receiveVerdict(t, req, func(ev Event) Verdict {
+		seen = ev
+		form := url.Values{}
+		for k, vs := range ev.Body.Form {
+			form[k] = vs
+		}
+		form.Set("amount", "1000")
+		return Verdict{Version: ProtocolVersion, Action: ActionModify, Body: &Body{Encoding: "form", Form: form}}
+	})
+
+	if seen.Body.Form.Get("amount") != "10" || seen.Body.Data != "amount=10&to=bob" {
+		t.Errorf("expected the debugger to see the form fields, got %+v", seen.Body)
+	}
+	if got.PostForm.Get("amount") != "1000" || got.PostForm.Get("to") != "bob" {
+		t.Errorf("expected the edited form, got %v", got.PostForm)
+	}
+}
+
+func TestReceiveMultipartDecoded(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("name", "wombat")
+	fw, _ := mw.CreateFormFile("upload", "data.bin")
+	fw.Write([]byte{0xff, 0x00, 0xfe})
+	mw.Close()
+	req, _ := http.NewRequest("POST", "http://example.com/hello", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var seen Event
+	got := receiveVerdict(t, req, func(ev Event) Verdict {
+		seen = ev
+		parts := append([]Part(nil), ev.Body.Parts...)
+		body := Body{Encoding: "multipart", ContentType: ev.Body.ContentType, Parts: parts}
+		body.Parts[0].Body = NewBody([]byte("numbat"))
+		return Verdict{Version: ProtocolVersion, Action: ActionModify, Body: &body}
+	})
+
+	if len(seen.Body.Parts) != 2 || seen.Body.Parts[0].Body.Data != "wombat" || seen.Body.Parts[1].Body.Encoding != "base64" {
+		t.Fatalf("expected the debugger to see the parts, got %+v", seen.Body.Parts)
+	}
+	if got.MultipartForm == nil || got.MultipartForm.Value["name"][0] != "numbat" || len(got.MultipartForm.File["upload"]) != 1 {
+		t.Errorf("expected the edited multipart form, got %+v", got.MultipartForm)
+	}
+}
+
+func mustRead(t *testing.T, req *http.Request) []byte {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(req.Body); err != nil {
+		t.Fatalf("unable to read body: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeContentBounded(t *testing.T) {
+	bomb, _ := encodeContent("gzip", make([]byte, maxDecodedBody+1))
+	if _, err := decodeContent("gzip", bomb, 0); err == nil {
+		t.Error("expected decoding with no limit to stop at maxDecodedBody")
+	}
+
+	// what is decoded counts against the buffer limit, the body is sent
+	// as it is if it does not fit
+	compressed, _ := encodeContent("gzip", bytes.Repeat([]byte("hello "), 100))
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, []byte("ok")}, WithMaxBufferedBytes(int64(len(compressed))+100))
+
+	req, _ := http.NewRequest("POST", "http://example.com/hello", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	m.ServeHTTP(httptest.NewRecorder(), withDebugSession(t, req, ds.URL, "receive example:/hello"))
+
+	evs := events()
+	if len(evs) != 1 || evs[0].Body.ContentEncoding != "" {
+		t.Fatalf("expected the body to be sent compressed, got %+v", evs)
+	}
+	if b, _ := evs[0].Body.Bytes(); !bytes.Equal(b, compressed) {
+		t.Errorf("expected the raw body, got %d bytes", len(b))
+	}
+}
+
+func TestReceiveRawDeflateKeepsFraming(t *testing.T) {
+	compressed, _ := encodeContent(rawDeflate, []byte("hello world"))
+	req, _ := http.NewRequest("POST", "http://example.com/hello", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "deflate")
+
+	var seen Event
+	got := receiveVerdict(t, req, func(ev Event) Verdict {
+		seen = ev
+		body := ev.Body
+		body.Data = "goodbye world"
+		return Verdict{Version: ProtocolVersion, Action: ActionModify, Body: &body}
+	})
+
+	if seen.Body.Data != "hello world" || seen.Body.ContentEncoding != "deflate" {
+		t.Errorf("expected the debugger to see the body decoded, got %+v", seen.Body)
+	}
+	sent := mustRead(t, got)
+	if !isRawDeflate(sent) {
+		t.Error("expected the edited body to be raw deflate, as it was sent")
+	}
+	raw, _ := ioutil.ReadAll(flate.NewReader(bytes.NewReader(sent)))
+	if string(raw) != "goodbye world" {
+		t.Errorf("expected the edited body, got '%s'", raw)
+	}
+}
@@ -0,0 +1,143 @@
+package rpcdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fidelityKey struct{}
+
+// snapshot is everything about a request a handler might depend on
+type snapshot struct {
+	Method           string
+	URL              string
+	RequestURI       string
+	Host             string
+	RemoteAddr       string
+	TLS              bool
+	Proto            string
+	ContextValue     interface{}
+	ContentLength    int64
+	TransferEncoding []string
+	Trailer          http.Header
+	Header           http.Header
+	Body             string
+	Form             string
+}
+
+type snapshotHandler struct {
+	seen snapshot
+}
+
+func (h *snapshotHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	header := req.Header.Clone()
+	for _, k := range []string{"Debug-Session", "Debug-Breakpoint", "Debug-Signature"} {
+		header.Del(k)
+	}
+	h.seen = snapshot{
+		Method:           req.Method,
+		URL:              req.URL.String(),
+		RequestURI:       req.RequestURI,
+		Host:             req.Host,
+		RemoteAddr:       req.RemoteAddr,
+		TLS:              req.TLS != nil,
+		Proto:            req.Proto,
+		ContextValue:     req.Context().Value(fidelityKey{}),
+		ContentLength:    req.ContentLength,
+		TransferEncoding: req.TransferEncoding,
+		Trailer:          req.Trailer,
+		Header:           header,
+		Body:             string(body),
+		Form:             req.FormValue("q"),
+	}
+}
+
+// fidelityRequest is a server side request with everything set which
+// a rebuilt request would lose
+func fidelityRequest(t *testing.T, session string) *http.Request {
+	req := httptest.NewRequest("POST", "https://example.com/hello?q=search", strings.NewReader("hello world"))
+	req.RemoteAddr = "192.0.2.7:4321"
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Request-Id", "abc")
+	req.Trailer = http.Header{"X-Checksum": nil}
+	req = req.WithContext(context.WithValue(req.Context(), fidelityKey{}, "from upstream"))
+	if session != "" {
+		req.Header.Add("Debug-Session", session)
+		req.Header.Add("Debug-Breakpoint", "receive example:/hello")
+		sign(t, req)
+	}
+	return req
+}
+
+func TestReceiveFidelity(t *testing.T) {
+	plain := &snapshotHandler{}
+	NewMiddleware(Identity{Service: "example"}, testKeys, plain).ServeHTTP(httptest.NewRecorder(), fidelityRequest(t, ""))
+
+	for _, c := range []struct {
+		name    string
+		verdict string
+		edit    func(*snapshot)
+	}{
+		{"continue", `{"version":1}`, func(s *snapshot) {}},
+		{"modify nothing", `{"version":1,"action":"modify"}`, func(s *snapshot) {}},
+		{"modify body", `{"version":1,"action":"modify","body":{"data":"goodbye"}}`, func(s *snapshot) {
+			s.Body = "goodbye"
+			s.ContentLength = 7
+		}},
+		{"modify method", `{"version":1,"action":"modify","method":"PUT"}`, func(s *snapshot) {
+			s.Method = "PUT"
+		}},
+		{"modify url", `{"version":1,"action":"modify","url":"/other?q=changed"}`, func(s *snapshot) {
+			s.URL = "https://example.com/other?q=changed"
+			s.RequestURI = "/other?q=changed"
+			s.Form = "changed"
+		}},
+		{"modify header", `{"version":1,"action":"modify","header":{"Content-Type":["text/plain"],"X-Request-Id":["xyz"]}}`, func(s *snapshot) {
+			s.Header = http.Header{"Content-Type": {"text/plain"}, "X-Request-Id": {"xyz"}}
+		}},
+	} {
+		ds := debugger(c.verdict)
+
+		debugged := &snapshotHandler{}
+		NewMiddleware(Identity{Service: "example"}, testKeys, debugged).ServeHTTP(httptest.NewRecorder(), fidelityRequest(t, ds.URL))
+		ds.Close()
+
+		want := plain.seen
+		want.Header = want.Header.Clone()
+		c.edit(&want)
+		if !reflect.DeepEqual(debugged.seen, want) {
+			t.Errorf("%s: handler saw\n%+v\nexpected\n%+v", c.name, debugged.seen, want)
+		}
+	}
+}
+
+func TestReceiveFidelityChunked(t *testing.T) {
+	for _, c := range []struct {
+		verdict          string
+		contentLength    int64
+		transferEncoding []string
+	}{
+		{`{"version":1,"action":"modify","header":{"X-Changed":["yes"]}}`, -1, []string{"chunked"}},
+		{`{"version":1,"action":"modify","body":{"data":"goodbye"}}`, 7, nil},
+	} {
+		ds := debugger(c.verdict)
+		req := fidelityRequest(t, ds.URL)
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+
+		h := &snapshotHandler{}
+		NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(httptest.NewRecorder(), req)
+		ds.Close()
+
+		if h.seen.ContentLength != c.contentLength || !reflect.DeepEqual(h.seen.TransferEncoding, c.transferEncoding) {
+			t.Errorf("%s: expected length %d and encoding %v, got %d and %v", c.verdict,
+				c.contentLength, c.transferEncoding, h.seen.ContentLength, h.seen.TransferEncoding)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package rpcdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modifiers limit how often a breakpoint triggers. They are written
+// after the `<service>:<rpc>` part of a breakpoint expression:
+//
+//	once      trigger only on the first hit
+//	after N   ignore the first N hits
+//	every N   trigger on every Nth hit (after any ignored ones)
+//	max N     trigger at most N times
+//
+// for example `receive example:/hello after 10 every 5 max 2`. Hits
+// are counted per session across every service, by rpcdbd.
+type Modifiers struct {
+	After int
+	Every int
+	Max   int
+}
+
+// ParseModifiers parses the modifier words from a breakpoint expression
+func ParseModifiers(words []string) (Modifiers, error) {
+	m := Modifiers{}
+	for i := 0; i < len(words); i++ {
+		if words[i] == "once" {
+			m.Max = 1
+			continue
+		}
+
+		var target *int
+		switch words[i] {
+		case "after":
+			target = &m.After
+		case "every":
+			target = &m.Every
+		case "max":
+			target = &m.Max
+		default:
+			return m, fmt.Errorf("unknown breakpoint modifier '%s'", words[i])
+		}
+		if i+1 >= len(words) {
+			return m, fmt.Errorf("breakpoint modifier '%s' needs a count", words[i])
+		}
+		n, err := strconv.Atoi(words[i+1])
+		if err != nil || n < 1 {
+			return m, fmt.Errorf("breakpoint modifier '%s' needs a positive count, got '%s'", words[i], words[i+1])
+		}
+		*target = n
+		i++
+	}
+	return m, nil
+}
+
+// IsZero reports whether there are no modifiers, in which case the
+// breakpoint triggers on every hit
+func (m Modifiers) IsZero() bool {
+	return m == Modifiers{}
+}
+
+// Decide whether a breakpoint triggers on this hit. hits counts every
+// hit so far, including this one, and fired counts how many of the
+// previous hits triggered. exhausted is true once the breakpoint will
+// never trigger again.
+func (m Modifiers) Decide(hits, fired int) (fire bool, exhausted bool) {
+	if m.Max > 0 && fired >= m.Max {
+		return false, true
+	}
+	n := hits - m.After
+	if n <= 0 {
+		return false, false
+	}
+	if m.Every > 1 && n%m.Every != 0 {
+		return false, false
+	}
+	return true, m.Max > 0 && fired+1 >= m.Max
+}
+
+// HitRequest is sent by the middleware to `<session url>/hits` when a
+// breakpoint with modifiers is hit. Breakpoint is the expression as
+// it appeared in the Debug-Breakpoint header.
+type HitRequest struct {
+	Breakpoint string `json:"breakpoint"`
+}
+
+// HitReply is rpcdbd's decision about a HitRequest
+type HitReply struct {
+	Fire      bool `json:"fire"`
+	Exhausted bool `json:"exhausted"`
+}
+
+// exhaustedBreakpoints remembers breakpoints which rpcdbd has told us
+// will never trigger again, so that we stop asking. Entries are kept
+// until their session expires.
+type exhaustedBreakpoints struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+var exhausted = &exhaustedBreakpoints{entries: map[string]time.Time{}}
+
+func (e *exhaustedBreakpoints) has(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.entries[key]
+	return ok
+}
+
+func (e *exhaustedBreakpoints) add(key string, until time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	for k, t := range e.entries {
+		if now.After(t) {
+			delete(e.entries, k)
+		}
+	}
+	e.entries[key] = until
+}
+
+// hit counts a hit on bp with rpcdbd and reports whether it triggers.
+// Nobody is waiting on a human here, so it is bounded by ctx as well
+// as the response timeout.
+func (s *Session) hit(ctx context.Context, bp Breakpoint) (bool, error) {
+	if bp.Modifiers.IsZero() {
+		return true, nil
+	}
+
+	key := s.SessionURL + "\n" + bp.Expression
+	if exhausted.has(key) {
+		return false, nil
+	}
+
+	body, err := json.Marshal(HitRequest{bp.Expression})
+	if err != nil {
+		return false, fmt.Errorf("unable to encode hit: %s", err)
+	}
+	ctx, cancel := s.exchange(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(s.SessionURL, "/")+"/hits", bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("error counting breakpoint hit: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.settings(ctx).debugger.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error counting breakpoint hit: %s", err)
+	}
+	defer resp.Body.Close()
+
+	reply := HitReply{}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&reply)
+		if err != nil {
+			return false, fmt.Errorf("unable to parse breakpoint hit reply: %s", err)
+		}
+	case http.StatusForbidden:
+		// rpcdbd does not count breakpoints it never signed, such as
+		// one a debugger added without its help, so it never fires
+		reply.Exhausted = true
+	default:
+		return false, fmt.Errorf("error counting breakpoint hit: %s", resp.Status)
+	}
+
+	if reply.Exhausted {
+		until := s.Expires
+		if until.IsZero() {
+			until = time.Now().Add(time.Hour)
+		}
+		exhausted.add(key, until)
+	}
+	return reply.Fire, nil
+}
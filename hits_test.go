@@ -0,0 +1,135 @@
+package rpcdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseModifiers(t *testing.T) {
+	bp, err := ParseExpression("receive example:/hello after 10 every 5 max 2 if method == POST")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if bp.Modifiers != (Modifiers{After: 10, Every: 5, Max: 2}) {
+		t.Errorf("unexpected modifiers %+v", bp.Modifiers)
+	}
+	if bp.RPCName != "/hello" || len(bp.Conditions) != 1 {
+		t.Errorf("modifiers confused parsing of the rest of the expression: %+v", bp)
+	}
+
+	bp, err = ParseExpression("receive example:/hello once")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if bp.Modifiers != (Modifiers{Max: 1}) {
+		t.Errorf("expected once to be max 1, got %+v", bp.Modifiers)
+	}
+
+	for _, expr := range []string{
+		"receive example:/hello twice",
+		"receive example:/hello after",
+		"receive example:/hello max 0",
+		"receive example:/hello every lots",
+	} {
+		if _, err := ParseExpression(expr); err == nil {
+			t.Errorf("expected '%s' to fail to parse", expr)
+		}
+	}
+}
+
+func TestModifiersDecide(t *testing.T) {
+	cases := []struct {
+		m     Modifiers
+		fires string
+	}{
+		{Modifiers{}, "yyyyyy"},
+		{Modifiers{Max: 1}, "ynnnnn"},
+		{Modifiers{After: 2}, "nnyyyy"},
+		{Modifiers{Every: 2}, "nynyny"},
+		{Modifiers{Max: 2}, "yynnnn"},
+		{Modifiers{After: 1, Every: 2, Max: 2}, "nnynyn"},
+	}
+
+	for _, c := range cases {
+		fired := 0
+		got := ""
+		for hits := 1; hits <= len(c.fires); hits++ {
+			fire, _ := c.m.Decide(hits, fired)
+			if fire {
+				fired++
+				got += "y"
+			} else {
+				got += "n"
+			}
+		}
+		if got != c.fires {
+			t.Errorf("%+v expected %s got %s", c.m, c.fires, got)
+		}
+	}
+}
+
+func TestModifiersExhausted(t *testing.T) {
+	m := Modifiers{Max: 2}
+	if _, exhausted := m.Decide(1, 0); exhausted {
+		t.Error("expected max 2 to not be exhausted after first fire")
+	}
+	if _, exhausted := m.Decide(2, 1); !exhausted {
+		t.Error("expected max 2 to be exhausted after second fire")
+	}
+}
+
+func TestHitBoundedByTimeouts(t *testing.T) {
+	hung := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer ds.Close()
+	defer close(hung)
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil},
+		WithFailurePolicy(FailOpen),
+		WithDebuggerTimeouts(time.Second, 20*time.Millisecond),
+		WithLogger(func(string, ...interface{}) {}))
+	start := time.Now()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello once"))
+	if w.Code != 200 || time.Since(start) > time.Second {
+		t.Errorf("expected counting the hit to be given up on, got %d after %s", w.Code, time.Since(start))
+	}
+
+	// without a response timeout the rpc's own deadline applies
+	session := &Session{SessionURL: ds.URL}
+	bp, _ := ParseExpression("receive example:/hello once")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := session.hit(ctx, bp); err == nil || time.Since(start) > time.Second {
+		t.Errorf("expected counting the hit to end with the rpc, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestUncountedHitDoesNotFire(t *testing.T) {
+	calls := 0
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/hits") {
+			http.Error(w, "breakpoint is not part of the session", http.StatusForbidden)
+			return
+		}
+		calls++
+		w.Write([]byte(`{"version":1,"action":"abort"}`))
+	}))
+	defer ds.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, debugRequest(t, ds.URL+"/uncounted", "receive example:/hello once"))
+		if w.Code != 200 || calls != 0 {
+			t.Errorf("expected an uncounted breakpoint to not fire, got %d with %d calls", w.Code, calls)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package rpcdb
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Identity is the full identity of a service instance under debug
+type Identity struct {
+	Region   string `json:"region,omitempty"`
+	Cluster  string `json:"cluster,omitempty"`
+	Service  string `json:"service"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// String renders the identity as `region/cluster/service/instance`
+func (id Identity) String() string {
+	return strings.Join([]string{id.Region, id.Cluster, id.Service, id.Instance}, "/")
+}
+
+// ServicePattern is the service half of a breakpoint expression, a
+// `/` separated path where each segment is a glob (see path.Match).
+// Segments line up with an Identity depending on how many there are:
+//
+//	service
+//	region/service
+//	region/cluster/service
+//	region/cluster/service/instance
+//
+// so `us-west-2/identity` matches every identity instance in
+// us-west-2, regardless of cluster, and `*/*/identity/i-1234` matches
+// exactly one instance.
+//
+// A `**` segment matches any number of whole segments, as it does in
+// an RPC name (see matchGlob). A pattern with one is matched against
+// `region/cluster/service` and `region/cluster/service/instance`, so
+// `us-west-2/**` matches everything in us-west-2, `**/identity` every
+// identity instance, and `**/i-1234` that instance wherever it is.
+type ServicePattern []string
+
+// ParseServicePattern parses the service half of a breakpoint expression
+func ParseServicePattern(s string) (ServicePattern, error) {
+	segments := strings.Split(s, "/")
+	fixed := 0
+	for _, seg := range segments {
+		if seg == "" {
+			return nil, fmt.Errorf("service pattern '%s' has an empty segment", s)
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("malformed service pattern '%s': %s", s, err)
+		}
+		if seg != "**" {
+			fixed++
+		}
+	}
+	if fixed > 4 {
+		return nil, fmt.Errorf("service pattern '%s' has more than 4 segments", s)
+	}
+	return ServicePattern(segments), nil
+}
+
+// Matches reports whether the pattern matches the identity
+func (p ServicePattern) Matches(id Identity) bool {
+	for _, seg := range p {
+		if seg == "**" {
+			full := []string{id.Region, id.Cluster, id.Service, id.Instance}
+			return matchSegments(p, full[:3]) || matchSegments(p, full)
+		}
+	}
+
+	var fields []string
+	switch len(p) {
+	case 1:
+		fields = []string{id.Service}
+	case 2:
+		fields = []string{id.Region, id.Service}
+	case 3:
+		fields = []string{id.Region, id.Cluster, id.Service}
+	case 4:
+		fields = []string{id.Region, id.Cluster, id.Service, id.Instance}
+	default:
+		return false
+	}
+	for i, seg := range p {
+		if ok, err := path.Match(seg, fields[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (p ServicePattern) String() string {
+	return strings.Join(p, "/")
+}
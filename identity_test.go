@@ -0,0 +1,102 @@
+package rpcdb
+
+import (
+	"testing"
+)
+
+func TestServicePatternMatches(t *testing.T) {
+	id := Identity{Region: "us-west-2", Cluster: "prod", Service: "identity", Instance: "i-1234"}
+
+	cases := []struct {
+		pattern string
+		match   bool
+	}{
+		{"identity", true},
+		{"ident*", true},
+		{"billing", false},
+		{"us-west-2/identity", true},
+		{"us-*/identity", true},
+		{"eu-west-1/identity", false},
+		{"us-west-2/prod/identity", true},
+		{"us-west-2/staging/identity", false},
+		{"*/*/identity/i-1234", true},
+		{"*/*/identity/i-9999", false},
+		{"*/*/*/*", true},
+	}
+
+	for _, c := range cases {
+		p, err := ParseServicePattern(c.pattern)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %s", c.pattern, err)
+			continue
+		}
+		if p.Matches(id) != c.match {
+			t.Errorf("pattern '%s' expected match=%v against %s", c.pattern, c.match, id)
+		}
+	}
+}
+
+func TestServicePatternDoubleStar(t *testing.T) {
+	id := Identity{Region: "us-west-2", Cluster: "prod", Service: "identity", Instance: "i-1234"}
+
+	cases := []struct {
+		pattern string
+		match   bool
+	}{
+		{"**", true},
+		{"us-west-2/**", true},
+		{"eu-west-1/**", false},
+		{"**/identity", true},
+		{"**/billing", false},
+		{"**/i-1234", true},
+		{"**/i-9999", false},
+		{"us-*/**/identity/i-1234", true},
+		{"**/prod/**", true},
+		{"**/staging/**", false},
+	}
+
+	for _, c := range cases {
+		p, err := ParseServicePattern(c.pattern)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %s", c.pattern, err)
+			continue
+		}
+		if p.Matches(id) != c.match {
+			t.Errorf("pattern '%s' expected match=%v against %s", c.pattern, c.match, id)
+		}
+	}
+
+	bp, err := ParseExpression("receive **:/hello")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if !bp.Matches(Identity{Service: "example"}, "/hello") {
+		t.Error("expected **:/hello to match any service")
+	}
+}
+
+func TestParseServicePatternErrors(t *testing.T) {
+	for _, s := range []string{"a/b/c/d/e", "a//c", "us-west-2/[", ""} {
+		if _, err := ParseServicePattern(s); err == nil {
+			t.Errorf("expected '%s' to fail to parse", s)
+		}
+	}
+}
+
+func TestParseHierarchicalExpr(t *testing.T) {
+	bp, err := ParseExpression("receive us-west-2/identity:facebook-auth")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if bp.ServiceName.String() != "us-west-2/identity" {
+		t.Errorf("expected service=us-west-2/identity, got %s", bp.ServiceName)
+	}
+	if bp.RPCName != "facebook-auth" {
+		t.Errorf("expected rpc=facebook-auth, got %s", bp.RPCName)
+	}
+
+	id := Identity{Region: "us-west-2", Cluster: "prod", Service: "identity", Instance: "i-1"}
+	if !bp.Matches(id, "facebook-auth") {
+		t.Errorf("expected breakpoint to match %s", id)
+	}
+}
@@ -0,0 +1,73 @@
+package rpcdb
+
+import (
+	"sync/atomic"
+)
+
+// limiter bounds the debug requests a middleware serves at once, and
+// the body bytes they hold. It never blocks, requests over the limits
+// are turned away, and normal requests never touch it.
+type limiter struct {
+	slots       chan struct{}
+	maxBuffered int64
+	buffered    int64
+}
+
+func newLimiter(c *config) *limiter {
+	l := &limiter{maxBuffered: c.maxBuffered}
+	if c.maxSessions > 0 {
+		l.slots = make(chan struct{}, c.maxSessions)
+	}
+	return l
+}
+
+// acquire takes a slot and reserves n buffered bytes, reporting false,
+// having taken nothing, if either is not available
+func (l *limiter) acquire(n int64) bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if !l.reserve(n) {
+		l.releaseSlot()
+		return false
+	}
+	return true
+}
+
+// reserve accounts for n more buffered bytes if that fits
+func (l *limiter) reserve(n int64) bool {
+	if n < 0 {
+		n = 0
+	}
+	total := atomic.AddInt64(&l.buffered, n)
+	if l.maxBuffered > 0 && total > l.maxBuffered {
+		atomic.AddInt64(&l.buffered, -n)
+		return false
+	}
+	return true
+}
+
+// release gives back a slot and n buffered bytes
+func (l *limiter) release(n int64) {
+	if n > 0 {
+		atomic.AddInt64(&l.buffered, -n)
+	}
+	l.releaseSlot()
+}
+
+// unreserve gives back n buffered bytes taken by reserve
+func (l *limiter) unreserve(n int64) {
+	if n > 0 {
+		atomic.AddInt64(&l.buffered, -n)
+	}
+}
+
+func (l *limiter) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
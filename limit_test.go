@@ -0,0 +1,105 @@
+package rpcdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(newConfig([]Option{WithMaxSessions(2), WithMaxBufferedBytes(100)}))
+
+	if !l.acquire(40) || !l.acquire(40) {
+		t.Fatal("expected two sessions within the limits to be admitted")
+	}
+	if l.acquire(0) {
+		t.Error("expected a third session to be rejected")
+	}
+	l.release(40)
+	if l.acquire(80) {
+		t.Error("expected a session over the buffer limit to be rejected")
+	}
+	if !l.acquire(60) {
+		t.Error("expected a session within the buffer limit to be admitted")
+	}
+}
+
+func TestMiddlewareRejectsWhenSaturated(t *testing.T) {
+	paused := make(chan struct{})
+	resume := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paused <- struct{}{}
+		<-resume
+		w.Write([]byte(`{"version":1}`))
+	}))
+	defer ds.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil},
+		WithMaxSessions(1),
+		WithRejection(http.StatusTooManyRequests, http.Header{"X-Debug-Rejected": {"yes"}}))
+
+	done := make(chan struct{})
+	go func() {
+		m.ServeHTTP(httptest.NewRecorder(), debugRequest(t, ds.URL, "receive example:/hello"))
+		close(done)
+	}()
+	<-paused
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Debug-Rejected") != "yes" {
+		t.Errorf("expected configured rejection, got %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("normal"))
+	m.ServeHTTP(w, req)
+	if w.Code != 200 || w.Body.String() != "normal" {
+		t.Errorf("expected normal requests to be unaffected, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	close(resume)
+	<-done
+
+	w = httptest.NewRecorder()
+	go func() { <-paused }()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != 200 {
+		t.Errorf("expected debug request to be admitted once the slot is free, got %d", w.Code)
+	}
+}
+
+func TestUnknownLengthReservesBodyLimit(t *testing.T) {
+	paused := make(chan struct{})
+	resume := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paused <- struct{}{}
+		<-resume
+		w.Write([]byte(`{"version":1}`))
+	}))
+	defer ds.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil},
+		WithMaxBufferedBytes(90), WithBodyLimit(80, Receive))
+
+	done := make(chan struct{})
+	go func() {
+		req := debugRequest(t, ds.URL, "receive example:/hello")
+		req.Body = ioutil.NopCloser(req.Body)
+		req.ContentLength = -1
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-paused
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a body of unknown length to hold the receive limit, got %d", w.Code)
+	}
+
+	close(resume)
+	<-done
+}
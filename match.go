@@ -0,0 +1,61 @@
+package rpcdb
+
+import (
+	"path"
+	"strings"
+)
+
+// Matches reports whether the breakpoint applies to the service
+// instance and RPC. Both halves of the breakpoint are glob patterns,
+// see ServicePattern and matchGlob for the syntax. An RPC pattern of
+// just `*` matches any RPC.
+func (bp Breakpoint) Matches(service Identity, rpc string) bool {
+	if !bp.ServiceName.Matches(service) {
+		return false
+	}
+	if bp.RPCName == "*" {
+		return true
+	}
+	return matchGlob(bp.RPCName, rpc)
+}
+
+// matchGlob matches name against pattern one `/` separated segment at
+// a time. Within a segment `*` matches any run of characters and `?`
+// matches any single character. A `**` segment matches zero or more
+// whole segments, so `/users/**` matches `/users`, `/users/1` and
+// `/users/1/photos`, while `/users/*` only matches `/users/1`.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			// collapse runs of ** as they mean the same as one
+			for len(patterns) > 0 && patterns[0] == "**" {
+				patterns = patterns[1:]
+			}
+			if len(patterns) == 0 {
+				return true
+			}
+			for i := range names {
+				if matchSegments(patterns, names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+		// segments never contain a '/', so path.Match is exactly a
+		// single segment glob match, a malformed pattern never matches
+		ok, err := path.Match(patterns[0], names[0])
+		if err != nil || !ok {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
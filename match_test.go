@@ -0,0 +1,63 @@
+package rpcdb
+
+import (
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"/hello", "/hello", true},
+		{"/hello", "/goodbye", false},
+		{"/hel?o", "/hello", true},
+		{"/hel?o", "/helo", false},
+		{"/users/*", "/users/1", true},
+		{"/users/*", "/users", false},
+		{"/users/*", "/users/1/photos", false},
+		{"/users/*/photos", "/users/1/photos", true},
+		{"/users/**", "/users", true},
+		{"/users/**", "/users/1/photos", true},
+		{"/users/**/photos", "/users/photos", true},
+		{"/users/**/photos", "/users/1/2/photos", true},
+		{"/users/**/photos", "/users/1/2/videos", false},
+		{"/api/v*/users", "/api/v2/users", true},
+		{"/api/v*/users", "/api/v2/beta/users", false},
+		{"**", "/anything/at/all", true},
+		{"ex*", "example", true},
+		{"ex*", "other", false},
+		{"[", "[", false},
+	}
+
+	for _, c := range cases {
+		if matchGlob(c.pattern, c.name) != c.match {
+			t.Errorf("matchGlob(%q, %q) expected %v", c.pattern, c.name, c.match)
+		}
+	}
+}
+
+func TestBreakpointMatches(t *testing.T) {
+	bp, err := ParseExpression("receive example:*")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if !bp.Matches(Identity{Service: "example"}, "/hello") {
+		t.Error("expected example:* to match any rpc on example")
+	}
+	if bp.Matches(Identity{Service: "other"}, "/hello") {
+		t.Error("expected example:* to not match other service")
+	}
+
+	bp, err = ParseExpression("reply *:/users/**")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if !bp.Matches(Identity{Service: "example"}, "/users/1") {
+		t.Error("expected *:/users/** to match example:/users/1")
+	}
+	if bp.Matches(Identity{Service: "example"}, "/groups/1") {
+		t.Error("expected *:/users/** to not match /groups/1")
+	}
+}
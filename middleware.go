@@ -1,30 +1,44 @@
 package rpcdb
 
 import (
+	"errors"
 	"net/http"
+	"time"
 )
 
 // Middleware represents the middleware
 type middleware struct {
-	name string
-	next http.Handler
+	identity Identity
+	verifier Verifier
+	next     http.Handler
+	config   *config
+	limiter  *limiter
 }
 
-// NewMiddleware directly builds the middleware handler
-func NewMiddleware(name string, next http.Handler) http.Handler {
-	return &middleware{name, next}
+// NewMiddleware directly builds the middleware handler for the
+// service instance identified by id. Only debug
+// requests whose Debug-Signature checks out against verifier are
+// debugged, anything else is served as though it were a normal
+// request. A nil verifier disables debugging.
+func NewMiddleware(id Identity, verifier Verifier, next http.Handler, opts ...Option) http.Handler {
+	return Constructor(id, verifier, opts...)(next)
 }
 
 // Constructor returns a function that creates middleware for the
-// given service name. This exists for Alice middleware chains.
-func Constructor(name string) func(http.Handler) http.Handler {
+// given service instance. This exists for Alice middleware chains.
+// Every handler it wraps shares the same limits on debug requests.
+func Constructor(id Identity, verifier Verifier, opts ...Option) func(http.Handler) http.Handler {
+	c := newConfig(opts)
+	l := newLimiter(c)
 	return func(next http.Handler) http.Handler {
-		return &middleware{name, next}
+		return &middleware{id, verifier, next, c, l}
 	}
 }
 
 func (m *middleware) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if isDebug(req) {
+	// unsigned, expired, or forged debug requests are ignored rather than
+	// rejected, they are handled exactly like any other request
+	if isDebug(req) && VerifySession(m.verifier, req.Header, time.Now()) == nil {
 		m.serveDebug(w, req)
 	} else {
 		m.next.ServeHTTP(w, req)
@@ -32,25 +46,96 @@ func (m *middleware) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (m middleware) serveDebug(w http.ResponseWriter, req *http.Request) {
-	session, err := BuildSession(m.name, req.Header)
+	// the request body is held in memory if a receive breakpoint hits,
+	// so it counts against the buffer limit from the start. A body of
+	// unknown length may come to as much as is allowed.
+	limit := m.config.bodyLimits[Receive]
+	reserved := req.ContentLength
+	if reserved < 0 {
+		reserved = limit
+		if reserved <= 0 {
+			reserved = m.config.maxBuffered
+		}
+	}
+	if limit > 0 && reserved > limit {
+		reserved = limit
+	}
+	if !m.limiter.acquire(reserved) {
+		m.reject(w)
+		return
+	}
+	defer func() { m.limiter.release(reserved) }()
+
+	session, err := buildSession(m.identity, req.Header, m.config)
+	if errors.Is(err, ErrSessionNotAllowed) {
+		// like a forged debug request, this is served as a normal one
+		m.config.logf("rpcdb: ignoring debug request: %s", err)
+		m.next.ServeHTTP(w, req)
+		return
+	}
 	if err != nil {
-		m.failWithError(w, err)
+		if m.failed(w, err) {
+			m.next.ServeHTTP(w, req)
+		}
+		return
 	}
 
+	session.limiter = m.limiter
+
+	// time paused at breakpoints must not count against the request's
+	// deadlines, or the server's read and write timeouts
+	ctx, cancel := session.extend(req.Context())
+	defer cancel()
+	session.extendDeadlines(w, req)
+
+	// the handler finds the session on its request context, so that
+	// DebugClient carries it on to whatever the handler calls
+	req = req.WithContext(AttachSession(ctx, session))
+
 	// receive hook
+	stop := keepAlive(w)
 	debugRequest, err := session.Receive(req)
-	if err != nil {
-		m.failWithError(w, err)
+	stop()
+	if halt, ok := err.(*Halt); ok {
+		m.halt(w, halt)
 		return
 	}
+	if err != nil {
+		if !m.failed(w, err) {
+			return
+		}
+		// Receive leaves the request untouched when it fails
+		debugRequest = req
+	}
+	if req.Body != nil {
+		// the body may be a replay of what Receive captured, which has
+		// to be let go of
+		defer req.Body.Close()
+	}
 
 	// reply hook
 	// TODO consider StartReply to Reply which takes a closure. More ruby than go, but reliable.
 	reply := session.StartReply(w, debugRequest)
+	defer reply.discard()
 	m.next.ServeHTTP(reply.CaptureWriter(), debugRequest)
-	err = reply.FinishReply()
-	if err != nil {
-		m.failWithError(w, err)
+	// FinishReply sends keep-alives itself, only while waiting on the
+	// debugger, as they must not race with writing the reply
+	wrote, err := reply.FinishReply()
+	if err != nil && wrote {
+		// too late to answer in place of a reply already on its way
+		stats.Add("debugger_failures", 1)
+		m.config.logf("rpcdb: debugging reply failed once sent: %s", err)
+		return
+	}
+	if halt, ok := err.(*Halt); ok {
+		m.halt(w, halt)
+		return
+	}
+	if err != nil && m.failed(w, err) {
+		err = reply.passThrough()
+		if err != nil {
+			m.config.logf("rpcdb: unable to send reply: %s", err)
+		}
 	}
 }
 
@@ -63,8 +148,49 @@ func isDebug(req *http.Request) bool {
 	return false
 }
 
-func (m middleware) failWithError(w http.ResponseWriter, e error) {
+// reject turns away a debug request when the limits have been reached
+func (m middleware) reject(w http.ResponseWriter) {
+	for k, vs := range m.config.rejectHeader {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(m.config.rejectStatus)
+	w.Write([]byte("too many debug requests"))
+}
+
+// halt answers in place of the handler when the debugger ended the rpc
+func (m middleware) halt(w http.ResponseWriter, h *Halt) {
+	if h.Reset {
+		// the sanctioned way to have net/http drop the connection
+		panic(http.ErrAbortHandler)
+	}
+	for k, vs := range h.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(h.Status)
+	w.Write(h.Body)
+}
+
+// failed handles a failure to debug an rpc, usually because the
+// debugger could not be reached, according to the failure policy. It
+// reports whether the rpc should carry on as though nothing happened.
+func (m middleware) failed(w http.ResponseWriter, e error) bool {
+	stats.Add("debugger_failures", 1)
+	if m.config.failure.open {
+		m.config.logf("rpcdb: debugging failed, carrying on: %s", e)
+		return true
+	}
+	m.config.logf("rpcdb: debugging failed: %s", e)
+	status := m.config.failure.status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	m.failWithError(w, status, e)
+	return false
+}
+
+func (m middleware) failWithError(w http.ResponseWriter, status int, e error) {
 	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(500)
+	w.WriteHeader(status)
 	w.Write([]byte(e.Error()))
 }
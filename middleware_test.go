@@ -1,20 +1,38 @@
 package rpcdb
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/justinas/alice"
 )
 
+var testKeys = HMACKeys{"test": []byte("not very secret")}
+
+// sign adds a valid Debug-Signature for the debug headers on req
+func sign(t *testing.T, req *http.Request) {
+	sig, err := SignSession(HMACSigner{"test", testKeys["test"]},
+		req.Header.Get(debugSessionHeaderKey),
+		breakpointExpressions(req.Header),
+		time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unable to sign request: %s", err)
+	}
+	req.Header.Set(debugSignatureHeaderKey, sig)
+}
+
 func ExampleConstructor() {
-	chain := alice.New(Constructor("example")).ThenFunc(handler)
+	chain := alice.New(Constructor(Identity{Service: "example"}, testKeys)).ThenFunc(handler)
 
 	err := http.ListenAndServe("127.0.0.1:3000", chain)
 	if err != nil {
@@ -22,6 +40,20 @@ func ExampleConstructor() {
 	}
 }
 
+func ExampleNewKeySet() {
+	// follow the keys rpcdbd rotates, rather than fetching them once
+	keys, err := NewKeySet(http.DefaultClient, "https://rpcdbd.internal/keys", 10*time.Minute)
+	if err != nil {
+		log.Panicf("unable to fetch keys: %s", err)
+	}
+	chain := alice.New(Constructor(Identity{Service: "example"}, keys)).ThenFunc(handler)
+
+	err = http.ListenAndServe("127.0.0.1:3000", chain)
+	if err != nil {
+		log.Panicf("unable to start: %s", err)
+	}
+}
+
 func handler(w http.ResponseWriter, req *http.Request) {
 	bytes, err := httputil.DumpRequest(req, true)
 	if err != nil {
@@ -56,9 +88,10 @@ func Test500OnBadBreakpoint(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	req.Header.Add("debug-breakpoint", "buggy example:*")
 	req.Header.Add("debug-session", "http://example/123")
+	sign(t, req)
 
 	handler := Stub{200, []byte("hello world")}
-	m := NewMiddleware("example", handler)
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, handler)
 	w := httptest.NewRecorder()
 
 	m.ServeHTTP(w, req)
@@ -81,19 +114,20 @@ func TestReceiveBodyTransform(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("content-type", "application/json")
 		// always respond with a body replacement
-		fmt.Fprintln(w, `{"body":"howdy world"}`)
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"howdy world"}}`)
 	}))
 	defer ts.Close()
 
 	// nil body makes the stub return whatever the input was :-)
 	handler := Stub{200, nil}
-	m := NewMiddleware("example", handler)
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, handler)
 	w := httptest.NewRecorder()
 
 	req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
 
 	req.Header.Add("Debug-Session", ts.URL)                      // debug session URL
 	req.Header.Add("Debug-Breakpoint", "receive example:/hello") // server receives /hello
+	sign(t, req)
 
 	m.ServeHTTP(w, req)
 
@@ -111,19 +145,20 @@ func TestReplyBodyTransform(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("content-type", "application/json")
 		// always respond with a body replacement
-		fmt.Fprintln(w, `{"body":"TRANSFORMED"}`)
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"TRANSFORMED"}}`)
 	}))
 	defer ts.Close()
 
 	// hardcode output as "hello world"
 	handler := Stub{200, []byte("hello world")}
-	m := NewMiddleware("example", handler)
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, handler)
 	w := httptest.NewRecorder()
 
 	req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("ignored"))
 
 	req.Header.Add("Debug-Session", ts.URL)                    // debug session URL
 	req.Header.Add("Debug-Breakpoint", "reply example:/hello") // server receives /hello
+	sign(t, req)
 
 	m.ServeHTTP(w, req)
 
@@ -137,6 +172,258 @@ func TestReplyBodyTransform(t *testing.T) {
 
 }
 
+func TestUnsignedDebugRequestIgnored(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"TRANSFORMED"}}`)
+	}))
+	defer ts.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil})
+
+	unsigned, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
+	unsigned.Header.Add("Debug-Session", ts.URL)
+	unsigned.Header.Add("Debug-Breakpoint", "receive example:/hello")
+
+	expired, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
+	expired.Header.Add("Debug-Session", ts.URL)
+	expired.Header.Add("Debug-Breakpoint", "receive example:/hello")
+	sig, _ := SignSession(HMACSigner{"test", testKeys["test"]}, ts.URL,
+		[]string{"receive example:/hello"}, time.Now().Add(-time.Minute))
+	expired.Header.Set("Debug-Signature", sig)
+
+	tampered, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
+	tampered.Header.Add("Debug-Session", ts.URL)
+	tampered.Header.Add("Debug-Breakpoint", "reply example:/hello")
+	sign(t, tampered)
+	tampered.Header.Add("Debug-Breakpoint", "receive example:/hello")
+
+	for name, req := range map[string]*http.Request{"unsigned": unsigned, "expired": expired, "tampered": tampered} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Body)
+		if string(body) != "hello world" {
+			t.Errorf("%s: expected untouched body 'hello world', got '%s'", name, body)
+		}
+	}
+	if called {
+		t.Error("debugger was called for a debug request which should have been ignored")
+	}
+}
+
+func TestWildcardReceiveBreakpoint(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"howdy world"}}`)
+	}))
+	defer ts.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil})
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "http://example.com/hello/there", strings.NewReader("hello world"))
+	req.Header.Add("Debug-Session", ts.URL)
+	req.Header.Add("Debug-Breakpoint", "receive ex*:*")
+	sign(t, req)
+
+	m.ServeHTTP(w, req)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	if string(body) != "howdy world" {
+		t.Errorf("Expected wildcard breakpoint to transform body to 'howdy world' got '%s'", body)
+	}
+}
+
+func TestConditionalReceiveBreakpoint(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"howdy world"}}`)
+	}))
+	defer ts.Close()
+
+	m := NewMiddleware(Identity{Service: "billing"}, testKeys, Stub{200, nil})
+
+	for input, expected := range map[string]string{
+		`{"amount": 5000}`: "howdy world",
+		`{"amount": 5}`:    `{"amount": 5}`,
+	} {
+		req, _ := http.NewRequest("POST", "http://example.com/charge", strings.NewReader(input))
+		req.Header.Add("Debug-Session", ts.URL)
+		req.Header.Add("Debug-Breakpoint", "receive billing:/charge if method == POST && $.amount > 1000")
+		sign(t, req)
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Body)
+		if string(body) != expected {
+			t.Errorf("for %s expected '%s' got '%s'", input, expected, body)
+		}
+	}
+}
+
+func TestConditionalReplyBreakpoint(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"TRANSFORMED"}}`)
+	}))
+	defer ts.Close()
+
+	for code, expected := range map[int]string{500: "TRANSFORMED", 200: "hello world"} {
+		m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{code, []byte("hello world")})
+
+		req, _ := http.NewRequest("GET", "http://example.com/hello", nil)
+		req.Header.Add("Debug-Session", ts.URL)
+		req.Header.Add("Debug-Breakpoint", "reply example:/hello if status >= 500")
+		sign(t, req)
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Body)
+		if string(body) != expected {
+			t.Errorf("for status %d expected '%s' got '%s'", code, expected, body)
+		}
+		if w.Code != code {
+			t.Errorf("expected status %d got %d", code, w.Code)
+		}
+	}
+}
+
+func TestOnceBreakpoint(t *testing.T) {
+	hits := 0
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/hits") {
+			// stand in for rpcdbd's counting
+			hits++
+			fire, exhausted := Modifiers{Max: 1}.Decide(hits, calls)
+			fmt.Fprintf(w, `{"fire":%v,"exhausted":%v}`, fire, exhausted)
+			return
+		}
+		calls++
+		fmt.Fprintln(w, `{"version":1,"action":"modify","body":{"encoding":"text","data":"howdy world"}}`)
+	}))
+	defer ts.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil})
+	for i, expected := range []string{"howdy world", "hello world", "hello world"} {
+		req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
+		req.Header.Add("Debug-Session", ts.URL+"/once")
+		req.Header.Add("Debug-Breakpoint", "receive example:/hello once")
+		sign(t, req)
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Body)
+		if string(body) != expected {
+			t.Errorf("request %d expected '%s' got '%s'", i, expected, body)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("expected debugger to be called once, was called %d times", calls)
+	}
+	if hits != 1 {
+		t.Errorf("expected middleware to stop counting hits once exhausted, counted %d", hits)
+	}
+}
+
+func TestTraceReceiveDoesNotPause(t *testing.T) {
+	events := make(chan Event, 1)
+	ds, _ := recordingDebugger(func(ev Event) string {
+		events <- ev
+		// a trace must ignore anything the debugger says
+		return `{"version":1,"action":"modify","body":{"encoding":"text","data":"TRANSFORMED"}}`
+	})
+	defer ds.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil})
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "trace receive example:/hello"))
+
+	body, _ := ioutil.ReadAll(w.Body)
+	if string(body) != "hello world" {
+		t.Errorf("expected trace to leave body as 'hello world', got '%s'", body)
+	}
+
+	select {
+	case ev := <-events:
+		if !ev.Trace || ev.Hook != "receive" || ev.Method != "POST" || ev.Body.Data != "hello world" {
+			t.Errorf("unexpected trace event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("trace event never arrived")
+	}
+}
+
+func TestReceiveEvent(t *testing.T) {
+	var ev Event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected event to be json, was %s", r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&ev)
+		// no body in the verdict leaves the body alone
+		fmt.Fprintln(w, `{"version":1}`)
+	}))
+	defer ts.Close()
+
+	id := Identity{Region: "us-west-2", Cluster: "prod", Service: "example", Instance: "i-1"}
+	m := NewMiddleware(id, testKeys, Stub{200, nil})
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("PUT", "http://example.com/hello?a=b", strings.NewReader("hello world"))
+	req.Header.Add("Debug-Session", ts.URL)
+	req.Header.Add("Debug-Breakpoint", "receive example:/hello")
+	req.Header.Add("Debug-Trace", "abc123")
+	req.Header.Add("X-Wombat", "true")
+	sign(t, req)
+
+	m.ServeHTTP(w, req)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	if string(body) != "hello world" {
+		t.Errorf("expected empty verdict to leave body as 'hello world', got '%s'", body)
+	}
+
+	if ev.Version != ProtocolVersion || ev.Hook != "receive" || ev.Breakpoint != "receive example:/hello" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if ev.Service != id {
+		t.Errorf("expected service %s got %s", id, ev.Service)
+	}
+	if ev.Method != "PUT" || ev.URL != "http://example.com/hello?a=b" || ev.Header.Get("X-Wombat") != "true" {
+		t.Errorf("unexpected event request details %+v", ev)
+	}
+	if !reflect.DeepEqual(ev.Body, Body{Encoding: "text", Data: "hello world"}) {
+		t.Errorf("unexpected event body %+v", ev.Body)
+	}
+	if ev.TraceID != "abc123" || ev.SpanID == "" {
+		t.Errorf("unexpected trace/span ids %s/%s", ev.TraceID, ev.SpanID)
+	}
+}
+
+func TestUnsupportedVerdictVersion(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"version":99,"body":{"encoding":"text","data":"howdy world"}}`)
+	}))
+	defer ts.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil})
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
+	req.Header.Add("Debug-Session", ts.URL)
+	req.Header.Add("Debug-Breakpoint", "receive example:/hello")
+	sign(t, req)
+
+	m.ServeHTTP(w, req)
+	if w.Code != 500 {
+		t.Errorf("expected 500 for unsupported verdict version, got %d", w.Code)
+	}
+}
+
 type Stub struct {
 	code int
 	body []byte
@@ -152,3 +439,144 @@ func (s Stub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		w.Write(s.body)
 	}
 }
+
+func TestSessionPropagatesThroughCallTree(t *testing.T) {
+	ds, events := recordingDebugger(func(Event) string { return `{"version":1}` })
+	defer ds.Close()
+
+	var seen http.Header
+	backendMiddleware := NewMiddleware(Identity{Service: "backend"}, testKeys, Stub{200, []byte("from backend")})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+		backendMiddleware.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	frontend := NewMiddleware(Identity{Service: "frontend"}, testKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ExtractSession(r.Context()); !ok {
+			t.Error("expected session on the handler's request context")
+		}
+		req, _ := http.NewRequest("GET", backend.URL+"/lookup", nil)
+		resp, err := NewClient(http.DefaultClient).Do(req.WithContext(r.Context()))
+		if err != nil {
+			t.Fatalf("error calling backend: %s", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/hello", nil)
+	req.Header.Add("Debug-Session", ds.URL)
+	req.Header.Add("Debug-Breakpoint", "receive frontend:/hello, receive backend:/lookup")
+	req.Header.Add("Debug-Trace", "abc123")
+	sign(t, req)
+
+	w := httptest.NewRecorder()
+	frontend.ServeHTTP(w, req)
+
+	if w.Body.String() != "from backend" {
+		t.Errorf("unexpected reply '%s'", w.Body.String())
+	}
+	hooks := []string{}
+	for _, ev := range events() {
+		hooks = append(hooks, ev.Service.Service+" "+ev.Hook)
+	}
+	if strings.Join(hooks, ",") != "frontend receive,backend receive" {
+		t.Errorf("expected breakpoints to trigger on both hops, got %v", hooks)
+	}
+	if seen.Get("Debug-Session") != ds.URL || seen.Get("Debug-Signature") != req.Header.Get("Debug-Signature") || seen.Get("Debug-Trace") != "abc123" {
+		t.Errorf("expected debug headers on outbound call, got %v", seen)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable := ds.URL
+	ds.Close()
+
+	failures := func() string {
+		if v := stats.Get("debugger_failures"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	before := failures()
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}, WithFailurePolicy(FailOpen)).
+		ServeHTTP(w, debugRequest(t, unreachable, "receive example:/hello"))
+	if w.Code != 200 || w.Body.String() != "hello world" {
+		t.Errorf("expected fail open to carry on untouched, got %d '%s'", w.Code, w.Body.String())
+	}
+	if failures() == before {
+		t.Error("expected the failure to be counted")
+	}
+
+	w = httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}, WithFailurePolicy(FailOpen)).
+		ServeHTTP(w, debugRequest(t, unreachable, "reply example:/hello"))
+	if w.Code != 200 || w.Body.String() != "hello world" {
+		t.Errorf("expected fail open to pass the reply through, got %d '%s'", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}, WithFailurePolicy(FailWithStatus(502))).
+		ServeHTTP(w, debugRequest(t, unreachable, "receive example:/hello"))
+	if w.Code != 502 {
+		t.Errorf("expected fail with status to answer 502, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}).
+		ServeHTTP(w, debugRequest(t, unreachable, "receive example:/hello"))
+	if w.Code != 500 {
+		t.Errorf("expected fail closed by default, got %d", w.Code)
+	}
+}
+
+// brokenWriter records the statuses written to it, and fails writes
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	statuses []int
+}
+
+func (w *brokenWriter) WriteHeader(status int) {
+	w.statuses = append(w.statuses, status)
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *brokenWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestFailedReplyWriteIsNotRepeated(t *testing.T) {
+	ds := debugger(`{"version":1}`)
+	defer ds.Close()
+
+	for _, policy := range []FailurePolicy{FailOpen, FailClosed} {
+		w := &brokenWriter{ResponseRecorder: httptest.NewRecorder()}
+		NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}, WithFailurePolicy(policy)).
+			ServeHTTP(w, debugRequest(t, ds.URL, "reply example:/hello"))
+		if len(w.statuses) != 1 || w.statuses[0] != 200 {
+			t.Errorf("expected the reply to be written once, got statuses %v", w.statuses)
+		}
+	}
+}
+
+func TestDebuggerResponseTimeout(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"version":1,"action":"abort"}`))
+	}))
+	defer ds.Close()
+
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil},
+		WithFailurePolicy(FailOpen),
+		WithDebuggerTimeouts(time.Second, 20*time.Millisecond))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != 200 || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("expected the debugger to be given up on, got %d after %s", w.Code, time.Since(start))
+	}
+}
@@ -0,0 +1,227 @@
+package rpcdb
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxSessions is how many debug requests a middleware serves at
+// once unless configured otherwise
+const DefaultMaxSessions = 5
+
+// DefaultConnectTimeout bounds connecting to the debugger unless
+// configured otherwise
+const DefaultConnectTimeout = 5 * time.Second
+
+// FailurePolicy says what the middleware does with an RPC when the
+// debugger cannot be reached, or its answer makes no sense
+type FailurePolicy struct {
+	open   bool
+	status int
+}
+
+var (
+	// FailOpen carries on with the RPC as though it had not hit a
+	// breakpoint, logging and counting the failure
+	FailOpen = FailurePolicy{open: true}
+	// FailClosed fails the RPC, this is the default. The middleware
+	// answers 500, clients return the error.
+	FailClosed = FailurePolicy{}
+)
+
+// FailWithStatus fails the RPC with the given status, clients return
+// a response with it
+func FailWithStatus(status int) FailurePolicy {
+	return FailurePolicy{status: status}
+}
+
+// Option configures the middleware, or a DebugClient or Transport.
+// Options given to a client take the place of the middleware's for
+// the hooks it runs, see NewTransport. The limits on debug requests
+// being served, WithMaxSessions, WithMaxBufferedBytes and
+// WithRejection, are ignored by clients.
+type Option func(*config)
+
+type config struct {
+	maxSessions  int
+	maxBuffered  int64
+	rejectStatus int
+	rejectHeader http.Header
+
+	failure         FailurePolicy
+	connectTimeout  time.Duration
+	responseTimeout time.Duration
+	debugger        *http.Client
+	logf            func(format string, v ...interface{})
+	allowed         []SessionPattern
+
+	// bodyLimits is indexed by HookType
+	bodyLimits [4]int64
+	spool      bool
+	spoolDir   string
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		maxSessions:    DefaultMaxSessions,
+		rejectStatus:   http.StatusServiceUnavailable,
+		rejectHeader:   http.Header{"Retry-After": {"1"}},
+		failure:        FailClosed,
+		connectTimeout: DefaultConnectTimeout,
+		logf:           log.Printf,
+		bodyLimits:     [4]int64{DefaultBodyLimit, DefaultBodyLimit, DefaultBodyLimit, DefaultBodyLimit},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.debugger == nil {
+		c.debugger = newDebuggerClient(c.connectTimeout)
+	} else {
+		c.debugger = withoutRedirects(c.debugger)
+	}
+	return c
+}
+
+// errDebuggerRedirect is returned for a debugger which answers with a
+// redirect, which could send events anywhere, past the allowed sessions
+var errDebuggerRedirect = errors.New("debugger redirects are not followed")
+
+// newDebuggerClient builds the client used to talk to debuggers. There
+// is no overall timeout, as a verdict waits on a human, but connecting
+// must not hang.
+func newDebuggerClient(connect time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = connect
+	return withoutRedirects(&http.Client{Transport: t})
+}
+
+// withoutRedirects returns a copy of hc which refuses to follow
+// redirects, leaving hc itself as it was
+func withoutRedirects(hc *http.Client) *http.Client {
+	c := *hc
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return errDebuggerRedirect
+	}
+	return &c
+}
+
+// defaultConfig is used where nothing was configured, such as by a
+// Transport which was not given options, or a session which was not
+// built by a middleware
+var defaultConfig = newConfig(nil)
+
+// WithMaxSessions limits how many debug requests may be in progress at
+// once, any more are rejected. Zero or less means no limit.
+func WithMaxSessions(n int) Option {
+	return func(c *config) {
+		c.maxSessions = n
+	}
+}
+
+// WithMaxBufferedBytes limits how many bytes of request and reply
+// bodies may be held in memory for debug requests at once. Debug
+// requests which would go over are rejected. Zero, the default, means
+// no limit.
+func WithMaxBufferedBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBuffered = n
+	}
+}
+
+// WithRejection sets the status and headers sent when a debug request
+// is rejected because of the limits, by default 503 with Retry-After.
+func WithRejection(status int, header http.Header) Option {
+	return func(c *config) {
+		c.rejectStatus = status
+		c.rejectHeader = header
+	}
+}
+
+// WithFailurePolicy sets what happens to an RPC when calling the
+// debugger fails
+func WithFailurePolicy(p FailurePolicy) Option {
+	return func(c *config) {
+		c.failure = p
+	}
+}
+
+// WithHTTPClient sets the client used to call the debugger, in place
+// of one which only bounds connecting, see WithDebuggerTimeouts. Its
+// Timeout should be long enough to wait on a human. A copy of it is
+// used which does not follow redirects.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *config) {
+		c.debugger = hc
+	}
+}
+
+// WithLogger sets where problems are reported, log.Printf by default
+func WithLogger(logf func(format string, v ...interface{})) Option {
+	return func(c *config) {
+		c.logf = logf
+	}
+}
+
+// WithDebuggerTimeouts bounds connecting to the debugger, and waiting
+// for its answer once connected. A response timeout of zero, the
+// default, waits as long as the session's budget allows. The response
+// timeout also bounds counting breakpoint hits with rpcdbd, as does
+// the RPC's deadline, and sending trace events, which otherwise give
+// up after 10 seconds.
+func WithDebuggerTimeouts(connect, response time.Duration) Option {
+	return func(c *config) {
+		c.connectTimeout = connect
+		c.responseTimeout = response
+	}
+}
+
+// WithAllowedSessions limits the debuggers the middleware will call to
+// Debug-Session URLs matching one of the patterns, see SessionPattern.
+// Debug requests for any other debugger are served as normal requests.
+// It panics if a pattern is malformed, as a typo here must not quietly
+// allow, or refuse, everything.
+func WithAllowedSessions(patterns ...string) Option {
+	allowed := []SessionPattern{}
+	for _, s := range patterns {
+		p, err := ParseSessionPattern(s)
+		if err != nil {
+			panic(err)
+		}
+		allowed = append(allowed, p)
+	}
+	return func(c *config) {
+		c.allowed = allowed
+	}
+}
+
+// WithBodyLimit limits how much of a body is held in memory for the
+// debugger by the given hooks, or all of them if none are given. By
+// default the start of a body over the limit is sent to the debugger,
+// marked truncated, while the whole body carries on untouched, see
+// WithBodySpool. Conditions on the body only see that start. Zero or
+// less means no limit.
+func WithBodyLimit(n int64, hooks ...HookType) Option {
+	if len(hooks) == 0 {
+		hooks = []HookType{Receive, Reply, Request, Response}
+	}
+	return func(c *config) {
+		for _, h := range hooks {
+			c.bodyLimits[h] = n
+		}
+	}
+}
+
+// WithBodySpool has bodies over the limit kept whole in temporary files
+// in dir, or the default temporary directory if dir is empty, so that
+// the debugger is sent all of them. They are streamed to the debugger
+// rather than read back into memory.
+func WithBodySpool(dir string) Option {
+	return func(c *config) {
+		c.spool = true
+		c.spoolDir = dir
+	}
+}
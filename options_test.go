@@ -0,0 +1,81 @@
+package rpcdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingTransport counts the requests made through it
+type countingTransport struct {
+	count int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	ds := debugger(`{"version":1}`)
+	defer ds.Close()
+
+	counting := &countingTransport{}
+	m := NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil},
+		WithHTTPClient(&http.Client{Transport: counting}))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != 200 || counting.count != 1 {
+		t.Errorf("expected the debugger to be called with the configured client, got %d calls", counting.count)
+	}
+}
+
+func TestClientFailurePolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer ts.Close()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable := ds.URL
+	ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", unreachable)
+	h.Add("Debug-Breakpoint", "request example:/")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+	ctx := AttachSession(context.Background(), session)
+
+	logged := []string{}
+	logf := func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+
+	c := NewClient(http.DefaultClient, WithFailurePolicy(FailOpen), WithLogger(logf)).Calling(Identity{Service: "example"})
+	resp, err := c.Get(ctx, ts.URL+"/")
+	if err != nil {
+		t.Fatalf("expected fail open to carry on, got %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello world" {
+		t.Errorf("expected untouched response, got '%s'", body)
+	}
+	if len(logged) != 1 {
+		t.Errorf("expected the failure to be logged, got %v", logged)
+	}
+
+	c = NewClient(http.DefaultClient, WithFailurePolicy(FailWithStatus(503)), WithLogger(logf)).Calling(Identity{Service: "example"})
+	resp, err = c.Get(ctx, ts.URL+"/")
+	if err != nil || resp.StatusCode != 503 {
+		t.Errorf("expected a 503 response, got %v %v", resp, err)
+	}
+
+	c = NewClient(http.DefaultClient, WithLogger(logf)).Calling(Identity{Service: "example"})
+	if _, err = c.Get(ctx, ts.URL+"/"); err == nil {
+		t.Error("expected fail closed to return the error")
+	}
+}
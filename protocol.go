@@ -0,0 +1,440 @@
+package rpcdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+)
+
+// ProtocolVersion is the version of the debugger wire protocol spoken
+// by this package. It is sent on every Event and must be sent back on
+// every Verdict.
+const ProtocolVersion = 1
+
+var debugTraceHeaderKey = http.CanonicalHeaderKey("Debug-Trace")
+
+// Event is POSTed, as JSON, to the Debug-Session URL when a breakpoint
+// triggers. The debugger answers with a Verdict. Events are also sent
+// for trace breakpoints, in which case Trace is set and the reply is
+// ignored.
+//
+// Callee is the service the RPC is addressed to. Caller is the service
+// making it, and is only known for request and response hooks, where
+// it is the service the event comes from.
+//
+// Chunk numbers, from 1, the pieces of a reply the handler streamed by
+// flushing it, in which case Body is just that piece. It is zero for
+// a whole reply.
+//
+// Status is only set for reply and response hooks. TraceID is shared
+// by every event in a debug session's call tree, SpanID is unique to
+// the event.
+type Event struct {
+	Version    int         `json:"version"`
+	Hook       string      `json:"hook"`
+	Trace      bool        `json:"trace,omitempty"`
+	Service    Identity    `json:"service"`
+	Caller     *Identity   `json:"caller,omitempty"`
+	Callee     Identity    `json:"callee"`
+	Breakpoint string      `json:"breakpoint"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header"`
+	Status     int         `json:"status,omitempty"`
+	Trailer    http.Header `json:"trailer,omitempty"`
+	Chunk      int         `json:"chunk,omitempty"`
+	Body       Body        `json:"body"`
+	TraceID    string      `json:"trace_id"`
+	SpanID     string      `json:"span_id"`
+
+	// spooled is the body, when it is too big for memory and is
+	// streamed to the debugger from disk. held is how many bytes of
+	// decoded body count against the middleware's buffer limit until
+	// the event has been sent.
+	spooled *payload
+	held    int64
+}
+
+// Verdict is the debugger's answer to an Event. Action says what to
+// do with the RPC:
+//
+//	continue  carry on unchanged, this is the default
+//	modify    carry on with the Method, URL, Header (request hooks),
+//	          Status, Header, Trailer (reply and response hooks) and
+//	          Body which are set. A non-nil Header or Trailer replaces
+//	          all of them, a nil Body leaves the body unchanged.
+//	abort     fail the RPC with Status, or drop the connection if
+//	          Reset is set
+//	delay     carry on unchanged after DelayMS milliseconds
+//	respond   skip the rest of the RPC and answer with Status,
+//	          Header and Body instead
+//
+// DelayMS is honored for every action, not just delay.
+//
+// Add and Remove change the session's breakpoints, whatever the
+// action, for the rest of this RPC and for the RPCs it makes with
+// DebugClient. This is how a debugger steps into or over a call.
+// Expressions are removed by exact match, see UpdateBreakpoints.
+// Without a new Debug-Signature in Signature covering the changed
+// breakpoints they only apply to this service, and other services are
+// sent the breakpoints the old signature covers. rpcdbd signs changed
+// breakpoints at `<Debug-Session>/sign`.
+type Verdict struct {
+	Version int         `json:"version"`
+	Action  string      `json:"action,omitempty"`
+	Method  string      `json:"method,omitempty"`
+	URL     string      `json:"url,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Trailer http.Header `json:"trailer,omitempty"`
+	Body    *Body       `json:"body,omitempty"`
+	Reset   bool        `json:"reset,omitempty"`
+	DelayMS int         `json:"delay_ms,omitempty"`
+
+	Add       []string `json:"add,omitempty"`
+	Remove    []string `json:"remove,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+}
+
+// Verdict actions
+const (
+	ActionContinue = "continue"
+	ActionModify   = "modify"
+	ActionAbort    = "abort"
+	ActionDelay    = "delay"
+	ActionRespond  = "respond"
+)
+
+// Halt is the error returned by a hook when the debugger ended the
+// RPC, with an abort or respond verdict. Whoever invoked the hook
+// answers with Status, Header, and Body in place of the real reply or
+// response, or drops the connection if Reset is set.
+type Halt struct {
+	Reset  bool
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+func (h *Halt) Error() string {
+	if h.Reset {
+		return "connection reset by debugger"
+	}
+	return fmt.Sprintf("debugger responded with %d", h.Status)
+}
+
+// response builds the synthetic response a client sees for req
+func (h *Halt) response(req *http.Request) (*http.Response, error) {
+	if h.Reset {
+		return nil, h
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", h.Status, http.StatusText(h.Status)),
+		StatusCode:    h.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(h.Body)),
+		ContentLength: int64(len(h.Body)),
+		Request:       req,
+	}, nil
+}
+
+// halt builds the Halt for an abort or respond verdict
+func (v Verdict) halt() (*Halt, error) {
+	h := &Halt{Reset: v.Reset, Status: v.Status, Header: v.header(http.Header{})}
+	if h.Status == 0 {
+		if v.Action == ActionAbort {
+			h.Status = http.StatusInternalServerError
+		} else {
+			h.Status = http.StatusOK
+		}
+	}
+	body, err := v.body(nil)
+	if err != nil {
+		return nil, err
+	}
+	h.Body = body
+	return h, nil
+}
+
+// body decodes the verdict's body, or returns orig if it has none
+func (v Verdict) body(orig []byte) ([]byte, error) {
+	if v.Body == nil {
+		return orig, nil
+	}
+	b, err := v.Body.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode body from debugger: %s", err)
+	}
+	return b, nil
+}
+
+// header returns the verdict's header, or orig if it has none, with
+// the Content-Type and Content-Encoding of the verdict's body if it
+// gives them
+func (v Verdict) header(orig http.Header) http.Header {
+	h := orig
+	if v.Header != nil {
+		h = v.Header
+	}
+	if v.Body == nil {
+		return h
+	}
+	contentType := v.Body.ContentType
+	if contentType == "" && v.Body.Encoding == "form" {
+		contentType = "application/x-www-form-urlencoded"
+	}
+	if contentType == "" && v.Body.ContentEncoding == "" {
+		return h
+	}
+	h = h.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	if v.Body.ContentEncoding != "" {
+		h.Set("Content-Encoding", v.Body.ContentEncoding)
+	}
+	return h
+}
+
+// trailer returns the verdict's trailer, or orig if it has none
+func (v Verdict) trailer(orig http.Header) http.Header {
+	if v.Trailer == nil {
+		return orig
+	}
+	return v.Trailer
+}
+
+// Body is a message body. Encoding is "text" when Data is the body
+// itself, which must be UTF-8, "base64" when Data is the base64
+// encoded body, or "json" when Value is the body, as a JSON value.
+// Events only use text and base64, so that bodies come back from the
+// debugger byte for byte, verdicts may use any of them.
+//
+// ContentType is the body's Content-Type. On an event it is that of
+// the message, on a verdict it replaces it.
+//
+// ContentEncoding is set when Data is the body with its gzip, deflate
+// or br Content-Encoding undone. A verdict's body is encoded with it
+// again, and the Content-Encoding set to match. Form and Parts break
+// out the fields of a form or multipart body on an event. A verdict
+// may give them in place of Data, with the encoding "form" or
+// "multipart", in which case ContentType must have the boundary.
+//
+// Truncated is set on an event's body when it was over the limit, and
+// Data is only its start, see WithBodyLimit. Size is then the length of
+// the whole body if it is known.
+type Body struct {
+	Encoding    string          `json:"encoding"`
+	Data        string          `json:"data"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Truncated   bool            `json:"truncated,omitempty"`
+	Size        int64           `json:"size,omitempty"`
+
+	ContentEncoding string     `json:"content_encoding,omitempty"`
+	Form            url.Values `json:"form,omitempty"`
+	Parts           []Part     `json:"parts,omitempty"`
+
+	// rawDeflate is set when a deflate body has no zlib wrapping
+	rawDeflate bool
+}
+
+// NewBody encodes b as text if it is valid UTF-8, otherwise as base64
+func NewBody(b []byte) Body {
+	if utf8.Valid(b) {
+		return Body{Encoding: "text", Data: string(b)}
+	}
+	return Body{Encoding: "base64", Data: base64.StdEncoding.EncodeToString(b)}
+}
+
+// Bytes decodes the body, and applies ContentEncoding, giving the body
+// as it is sent
+func (b Body) Bytes() ([]byte, error) {
+	data, err := b.decode()
+	if err != nil || b.ContentEncoding == "" {
+		return data, err
+	}
+	if b.rawDeflate && b.ContentEncoding == "deflate" {
+		return encodeContent(rawDeflate, data)
+	}
+	return encodeContent(b.ContentEncoding, data)
+}
+
+func (b Body) decode() ([]byte, error) {
+	switch b.Encoding {
+	case "text", "":
+		return []byte(b.Data), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(b.Data)
+	case "json":
+		if len(b.Value) == 0 {
+			return nil, errors.New("json body has no value")
+		}
+		return []byte(b.Value), nil
+	case "form":
+		return []byte(b.Form.Encode()), nil
+	case "multipart":
+		return writeParts(b.Parts, b.ContentType)
+	}
+	return nil, fmt.Errorf("unknown body encoding '%s'", b.Encoding)
+}
+
+// event describes msg, which triggered bp in ctx
+func (s *Session) event(ctx context.Context, bp Breakpoint, msg message) Event {
+	ev := Event{
+		Version:    ProtocolVersion,
+		Hook:       bp.Hook.String(),
+		Trace:      bp.Trace,
+		Service:    s.Identity,
+		Callee:     msg.callee,
+		Breakpoint: bp.Expression,
+		Method:     msg.method,
+		Header:     msg.header,
+		Status:     msg.status,
+		Trailer:    msg.trailer,
+		Chunk:      msg.chunk,
+		Body:       NewBody(msg.body),
+		TraceID:    s.TraceID,
+		SpanID:     newID(8),
+	}
+	if bp.Hook == Request || bp.Hook == Response {
+		caller := s.Identity
+		ev.Caller = &caller
+	}
+	if msg.url != nil {
+		ev.URL = msg.url.String()
+	}
+	if msg.payload != nil {
+		ev.Body = msg.payload.encode()
+		if msg.payload.spool != nil {
+			ev.spooled = msg.payload
+		}
+	}
+	ev.Body.ContentType = msg.header.Get("Content-Type")
+	if p := msg.payload; p == nil || (!p.truncated && p.spool == nil) {
+		ev.held = ev.Body.inspect(msg.header, msg.body, s.settings(ctx).bodyLimits[bp.Hook], s.reserve)
+	}
+	return ev
+}
+
+// exchange bounds one request to the debugger, once connected, by the
+// response timeout if there is one, see WithDebuggerTimeouts
+func (s *Session) exchange(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := s.settings(ctx).responseTimeout; timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// call sends an event to the debugger and waits for its verdict,
+// then waits out any delay the debugger asked for. The wait is not
+// bounded by ctx's deadline but by the session's budget, and is time
+// which counts against that budget. Cancelling ctx cancels the wait.
+func (s *Session) call(ctx context.Context, ev Event) (Verdict, error) {
+	verdict := Verdict{}
+	defer s.unreserve(ev.held)
+	body, err := encodeEvent(ev)
+	if err != nil {
+		return verdict, fmt.Errorf("unable to encode debugger event: %s", err)
+	}
+
+	ctx, cancel := s.pause(ctx)
+	defer cancel()
+	defer func(start time.Time) { s.pausedFor(time.Since(start)) }(time.Now())
+
+	exchange, cancelExchange := s.exchange(ctx)
+	defer cancelExchange()
+
+	req, err := http.NewRequestWithContext(exchange, "POST", s.SessionURL, body)
+	if err != nil {
+		body.Close()
+		return verdict, fmt.Errorf("error calling debugger: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.settings(ctx).debugger.Do(req)
+	if err != nil {
+		return verdict, fmt.Errorf("error calling debugger: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var verdictBody []byte
+	if limit := s.settings(ctx).verdictLimit(); limit > 0 {
+		verdictBody, err = ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err == nil && int64(len(verdictBody)) > limit {
+			err = fmt.Errorf("over %d bytes", limit)
+		}
+	} else {
+		verdictBody, err = ioutil.ReadAll(resp.Body)
+	}
+	if err != nil {
+		return verdict, fmt.Errorf("unable to read response from debugger: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return verdict, fmt.Errorf("debugger responded %s", resp.Status)
+	}
+
+	err = json.Unmarshal(verdictBody, &verdict)
+	if err != nil {
+		return verdict, fmt.Errorf("unable to parse response from debugger: %s", err)
+	}
+	if verdict.Version != ProtocolVersion {
+		return verdict, fmt.Errorf("unsupported debugger protocol version %d", verdict.Version)
+	}
+	if verdict.Body != nil && verdict.Body.ContentEncoding == ev.Body.ContentEncoding {
+		// a body encoded the way the message was keeps its framing
+		verdict.Body.rawDeflate = ev.Body.rawDeflate
+	}
+
+	switch verdict.Action {
+	case "":
+		verdict.Action = ActionContinue
+	case ActionContinue, ActionModify, ActionAbort, ActionDelay, ActionRespond:
+	default:
+		return verdict, fmt.Errorf("unknown debugger action '%s'", verdict.Action)
+	}
+	switch verdict.Action {
+	case ActionModify, ActionAbort, ActionRespond:
+		// net/http panics on anything else, and 1xx is not a reply
+		if verdict.Status != 0 && (verdict.Status < 200 || verdict.Status > 999) {
+			return verdict, fmt.Errorf("invalid status %d from debugger", verdict.Status)
+		}
+	}
+	if err := s.apply(verdict); err != nil {
+		return verdict, err
+	}
+
+	if verdict.DelayMS > 0 {
+		timer := time.NewTimer(time.Duration(verdict.DelayMS) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return verdict, errors.New("rpc cancelled during debugger delay")
+		}
+	}
+	return verdict, nil
+}
+
+// newID generates a random hex id of n bytes
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,492 @@
+package rpcdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBodyRoundTrip(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("hello world"),
+		{0xff, 0xfe, 0x00, 0x01},
+		{},
+	} {
+		body := NewBody(b)
+		decoded, err := body.Bytes()
+		if err != nil {
+			t.Errorf("unable to decode %+v: %s", body, err)
+		}
+		if !bytes.Equal(decoded, b) {
+			t.Errorf("expected %v got %v", b, decoded)
+		}
+	}
+
+	if NewBody([]byte("hello")).Encoding != "text" {
+		t.Error("expected utf-8 body to be sent as text")
+	}
+	if NewBody([]byte{0xff}).Encoding != "base64" {
+		t.Error("expected non utf-8 body to be sent as base64")
+	}
+	if _, err := (Body{Encoding: "rot13", Data: "uryyb"}).Bytes(); err == nil {
+		t.Error("expected unknown encoding to fail")
+	}
+}
+
+// debugger stands up a fake rpcdbd which answers every event with verdict
+func debugger(verdict string) *httptest.Server {
+	ds, _ := recordingDebugger(func(Event) string { return verdict })
+	return ds
+}
+
+// recordingDebugger stands up a fake rpcdbd which answers each event
+// with whatever verdict returns for it. events returns the events it
+// has been sent so far.
+func recordingDebugger(verdict func(Event) string) (ds *httptest.Server, events func() []Event) {
+	var mu sync.Mutex
+	seen := []Event{}
+	ds = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := Event{}
+		json.NewDecoder(r.Body).Decode(&ev)
+		mu.Lock()
+		seen = append(seen, ev)
+		mu.Unlock()
+		fmt.Fprintln(w, verdict(ev))
+	}))
+	return ds, func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Event(nil), seen...)
+	}
+}
+
+// debugRequest builds a signed debug request for breakpoint
+func debugRequest(t *testing.T, session, breakpoint string) *http.Request {
+	req, _ := http.NewRequest("POST", "http://example.com/hello", strings.NewReader("hello world"))
+	return withDebugSession(t, req, session, breakpoint)
+}
+
+// debugGet builds a signed debug request for breakpoint, getting
+// /hello from the server at target
+func debugGet(t *testing.T, target, session, breakpoint string) *http.Request {
+	req, _ := http.NewRequest("GET", target+"/hello", nil)
+	return withDebugSession(t, req, session, breakpoint)
+}
+
+// withDebugSession adds session and breakpoint to req's debug headers,
+// and signs them
+func withDebugSession(t *testing.T, req *http.Request, session, breakpoint string) *http.Request {
+	req.Header.Add("Debug-Session", session)
+	req.Header.Add("Debug-Breakpoint", breakpoint)
+	sign(t, req)
+	return req
+}
+
+// recordingHandler records whether it was called and the request it saw
+type recordingHandler struct {
+	called bool
+	method string
+	header http.Header
+	body   string
+}
+
+func (h *recordingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.called = true
+	h.method = req.Method
+	h.header = req.Header
+	b, _ := ioutil.ReadAll(req.Body)
+	h.body = string(b)
+	w.Header().Set("X-Handler", "yes")
+	w.WriteHeader(200)
+	w.Write([]byte("handled"))
+}
+
+func TestReceiveContinue(t *testing.T) {
+	for _, verdict := range []string{`{"version":1}`, `{"version":1,"action":"continue","body":{"data":"ignored"}}`} {
+		ds := debugger(verdict)
+		h := &recordingHandler{}
+		w := httptest.NewRecorder()
+		NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+		ds.Close()
+
+		if !h.called || h.body != "hello world" {
+			t.Errorf("%s: expected handler to see 'hello world', saw '%s'", verdict, h.body)
+		}
+	}
+}
+
+func TestReceiveModify(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"modify","method":"PUT","header":{"X-Added":["yes"]},"body":{"encoding":"base64","data":"aG93ZHk="}}`)
+	defer ds.Close()
+
+	h := &recordingHandler{}
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+
+	if h.method != "PUT" || h.header.Get("X-Added") != "yes" || h.body != "howdy" {
+		t.Errorf("expected modified request, handler saw %s %v '%s'", h.method, h.header, h.body)
+	}
+	if h.header.Get("Debug-Session") != "" {
+		t.Error("expected verdict header to replace all request headers")
+	}
+}
+
+func TestReceiveAbort(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"abort","status":503}`)
+	defer ds.Close()
+
+	h := &recordingHandler{}
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+
+	if h.called {
+		t.Error("expected handler to not be called on abort")
+	}
+	if w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestReceiveAbortReset(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"abort","reset":true}`)
+	defer ds.Close()
+
+	h := &recordingHandler{}
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("expected reset to abort the handler, got %v", r)
+		}
+		if h.called {
+			t.Error("expected handler to not be called on reset")
+		}
+	}()
+	NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(httptest.NewRecorder(), debugRequest(t, ds.URL, "receive example:/hello"))
+}
+
+func TestReceiveDelay(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"delay","delay_ms":50}`)
+	defer ds.Close()
+
+	h := &recordingHandler{}
+	start := time.Now()
+	NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(httptest.NewRecorder(), debugRequest(t, ds.URL, "receive example:/hello"))
+
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected delay of at least 50ms, took %s", time.Since(start))
+	}
+	if h.body != "hello world" {
+		t.Errorf("expected delay to leave body alone, handler saw '%s'", h.body)
+	}
+}
+
+func TestReceiveRespond(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"respond","status":201,"header":{"X-Debugger":["yes"]},"body":{"data":"from the debugger"}}`)
+	defer ds.Close()
+
+	h := &recordingHandler{}
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+
+	if h.called {
+		t.Error("expected handler to not be called on respond")
+	}
+	if w.Code != 201 || w.Header().Get("X-Debugger") != "yes" || w.Body.String() != "from the debugger" {
+		t.Errorf("unexpected synthetic reply %d %v '%s'", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestReplyModify(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"modify","status":202,"body":{"data":"changed"}}`)
+	defer ds.Close()
+
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, &recordingHandler{}).ServeHTTP(w, debugRequest(t, ds.URL, "reply example:/hello"))
+
+	if w.Code != 202 || w.Body.String() != "changed" {
+		t.Errorf("unexpected modified reply %d '%s'", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Handler") != "yes" {
+		t.Errorf("expected handler's headers to be kept, got %v", w.Header())
+	}
+}
+
+func TestReplyAbort(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"abort"}`)
+	defer ds.Close()
+
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, &recordingHandler{}).ServeHTTP(w, debugRequest(t, ds.URL, "reply example:/hello"))
+
+	if w.Code != 500 || w.Body.String() == "handled" {
+		t.Errorf("expected abort to replace the reply with a 500, got %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestRespond(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+
+	ds := debugger(`{"version":1,"action":"respond","status":418,"body":{"data":"short and stout"}}`)
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", ds.URL)
+	h.Add("Debug-Breakpoint", "request example:/")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+
+	resp, err := NewClient(http.DefaultClient).Calling(Identity{Service: "example"}).Get(AttachSession(context.Background(), session), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 418 || string(body) != "short and stout" {
+		t.Errorf("unexpected synthetic response %d '%s'", resp.StatusCode, body)
+	}
+	if called {
+		t.Error("expected respond to skip calling the server")
+	}
+}
+
+func TestResponseModifyAndReset(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer ts.Close()
+
+	ds := debugger(`{"version":1,"action":"modify","status":500,"header":{"X-Changed":["yes"]}}`)
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", ds.URL)
+	h.Add("Debug-Breakpoint", "response example:/")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+	c := NewClient(http.DefaultClient).Calling(Identity{Service: "example"})
+
+	resp, err := c.Get(AttachSession(context.Background(), session), ts.URL+"/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 500 || resp.Header.Get("X-Changed") != "yes" || string(body) != "hello world" {
+		t.Errorf("unexpected modified response %d %v '%s'", resp.StatusCode, resp.Header, body)
+	}
+
+	reset := debugger(`{"version":1,"action":"abort","reset":true}`)
+	defer reset.Close()
+	session.SessionURL = reset.URL
+
+	_, err = c.Get(AttachSession(context.Background(), session), ts.URL+"/")
+	if _, ok := err.(*Halt); !ok {
+		t.Errorf("expected reset to fail the request with a Halt, got %v", err)
+	}
+}
+
+func TestUnknownAction(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"explode"}`)
+	defer ds.Close()
+
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, &recordingHandler{}).ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+	if w.Code != 500 {
+		t.Errorf("expected unknown action to fail, got %d", w.Code)
+	}
+}
+
+func TestInvalidVerdictStatus(t *testing.T) {
+	for _, verdict := range []string{
+		`{"version":1,"action":"abort","status":42}`,
+		`{"version":1,"action":"respond","status":1000}`,
+		`{"version":1,"action":"modify","status":101}`,
+	} {
+		ds := debugger(verdict)
+		for _, bp := range []string{"receive example:/hello", "reply example:/hello"} {
+			w := httptest.NewRecorder()
+			NewMiddleware(Identity{Service: "example"}, testKeys, Stub{200, nil}, WithFailurePolicy(FailOpen),
+				WithLogger(func(string, ...interface{}) {})).
+				ServeHTTP(w, debugRequest(t, ds.URL, bp))
+			if w.Code != 200 || w.Body.String() != "hello world" {
+				t.Errorf("expected %s at '%s' to fail open, got %d '%s'", verdict, bp, w.Code, w.Body.String())
+			}
+		}
+		ds.Close()
+	}
+}
+
+func TestVerdictAddsBreakpoint(t *testing.T) {
+	ds, events := recordingDebugger(func(ev Event) string {
+		if ev.Hook == "receive" {
+			return `{"version":1,"add":["reply example:/hello"]}`
+		}
+		return `{"version":1,"action":"modify","body":{"data":"stepped"}}`
+	})
+	defer ds.Close()
+
+	w := httptest.NewRecorder()
+	NewMiddleware(Identity{Service: "example"}, testKeys, &recordingHandler{}).ServeHTTP(w, debugRequest(t, ds.URL, "receive example:/hello"))
+
+	hooks := []string{}
+	for _, ev := range events() {
+		hooks = append(hooks, ev.Hook)
+	}
+	if strings.Join(hooks, ",") != "receive,reply" {
+		t.Errorf("expected added reply breakpoint to trigger in the same rpc, got %v", hooks)
+	}
+	if w.Body.String() != "stepped" {
+		t.Errorf("expected reply verdict to apply, got '%s'", w.Body.String())
+	}
+}
+
+func TestUnsignedChangeKeepsSignedBreakpoints(t *testing.T) {
+	var seen http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer ts.Close()
+
+	ds := debugger(`{"version":1,"add":["reply example:/hello"]}`)
+	defer ds.Close()
+
+	session, _ := BuildSession(Identity{Service: "example"}, debugRequest(t, ds.URL, "request example:/").Header)
+	c := NewClient(http.DefaultClient).Calling(Identity{Service: "example"})
+	if _, err := c.Get(AttachSession(context.Background(), session), ts.URL+"/"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(session.ReplyBreakpoints) != 1 {
+		t.Errorf("expected the unsigned change to apply locally, got %v", session.Expressions)
+	}
+	if got := seen[debugBreakpointHeaderKey]; strings.Join(got, "|") != "request example:/" {
+		t.Errorf("expected only the signed breakpoints on the outbound call, got %v", got)
+	}
+	if err := VerifySession(testKeys, seen, time.Now()); err != nil {
+		t.Errorf("expected the outbound call to still verify: %s", err)
+	}
+}
+
+func TestVerdictStepInto(t *testing.T) {
+	var seen http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer ts.Close()
+
+	ds, events := recordingDebugger(func(Event) string {
+		return `{"version":1,"add":["receive other:*"],"remove":["request example:/"],"signature":"keyid=test; expires=4102444800; sig=abc"}`
+	})
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", ds.URL)
+	h.Add("Debug-Breakpoint", "request example:/, response example:/nothing")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+	c := NewClient(http.DefaultClient).Calling(Identity{Service: "example"})
+	ctx := AttachSession(context.Background(), session)
+
+	if _, err := c.Get(ctx, ts.URL+"/"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got := seen[debugBreakpointHeaderKey]
+	if strings.Join(got, "|") != "response example:/nothing|receive other:*" {
+		t.Errorf("expected rewritten breakpoints on the outbound call, got %v", got)
+	}
+	if seen.Get("Debug-Signature") != "keyid=test; expires=4102444800; sig=abc" {
+		t.Errorf("expected new signature on the outbound call, got '%s'", seen.Get("Debug-Signature"))
+	}
+	if seen.Get("Debug-Trace") != session.TraceID {
+		t.Errorf("expected trace id to propagate, got '%s'", seen.Get("Debug-Trace"))
+	}
+	if session.Expires.Unix() != 4102444800 {
+		t.Errorf("expected expiry from the new signature, got %s", session.Expires)
+	}
+
+	if _, err := c.Get(ctx, ts.URL+"/"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(events()) != 1 {
+		t.Errorf("expected removed breakpoint to stop triggering, debugger called %d times", len(events()))
+	}
+}
+
+func TestUpdateBreakpoints(t *testing.T) {
+	got := UpdateBreakpoints([]string{"receive a:*", "reply a:*"}, []string{" request b:* "}, []string{"receive a:*"})
+	if strings.Join(got, "|") != "reply a:*|request b:*" {
+		t.Errorf("unexpected updated breakpoints %v", got)
+	}
+}
+
+func TestBinaryBodiesRoundTrip(t *testing.T) {
+	payload := make([]byte, 4096)
+	rand.Read(payload)
+
+	// the debugger sends back every body just as it got it
+	ds, events := recordingDebugger(func(ev Event) string {
+		verdict, _ := json.Marshal(Verdict{Version: ProtocolVersion, Action: ActionModify, Body: &ev.Body})
+		return string(verdict)
+	})
+	defer ds.Close()
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	})
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, echo))
+	defer ts.Close()
+
+	header := http.Header{}
+	header.Set("Debug-Session", ds.URL)
+	for _, hook := range []string{"request", "receive", "reply", "response"} {
+		header.Add("Debug-Breakpoint", hook+" example:/echo")
+	}
+	req := &http.Request{Header: header}
+	sign(t, req)
+	session, err := BuildSession(Identity{Service: "client"}, req.Header)
+	if err != nil {
+		t.Fatalf("unable to build session: %s", err)
+	}
+
+	c := NewClient(http.DefaultClient).Calling(Identity{Service: "example"})
+	ctx := AttachSession(context.Background(), session)
+	resp, err := c.Post(ctx, ts.URL+"/echo", "application/octet-stream", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if !bytes.Equal(body, payload) {
+		t.Errorf("expected random bytes to survive all four hooks, got %d bytes back", len(body))
+	}
+	for _, ev := range events() {
+		b, err := ev.Body.Bytes()
+		if err != nil || !bytes.Equal(b, payload) {
+			t.Errorf("expected the debugger to see the random bytes at %s, got %d bytes: %v", ev.Hook, len(b), err)
+		}
+	}
+	if len(events()) != 4 {
+		t.Errorf("expected the debugger to see all four hooks, got %d events", len(events()))
+	}
+}
+
+func TestJSONVerdictBody(t *testing.T) {
+	ds := debugger(`{"version":1,"action":"modify","body":{"encoding":"json","value":{"id": 42},"content_type":"application/json"}}`)
+	defer ds.Close()
+
+	h := &recordingHandler{}
+	NewMiddleware(Identity{Service: "example"}, testKeys, h).ServeHTTP(httptest.NewRecorder(), debugRequest(t, ds.URL, "receive example:/hello"))
+
+	if h.body != `{"id": 42}` || h.header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected the json value as the body, got '%s' %v", h.body, h.header)
+	}
+}
@@ -0,0 +1,120 @@
+package rpcdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveReply serves handler behind the middleware and requests /hello
+// with a reply breakpoint, answered with verdict. It returns the
+// response, with its body read, and the event the debugger saw.
+func serveReply(t *testing.T, verdict string, handler http.HandlerFunc) (*http.Response, []byte, Event) {
+	ds, events := recordingDebugger(func(Event) string { return verdict })
+	defer ds.Close()
+	ts := httptest.NewServer(NewMiddleware(Identity{Service: "example"}, testKeys, handler))
+	defer ts.Close()
+
+	// ask for the raw bytes, gzip included
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(debugGet(t, ts.URL, ds.URL, "reply example:/hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read reply: %s", err)
+	}
+	ev := Event{}
+	if got := events(); len(got) > 0 {
+		ev = got[len(got)-1]
+	}
+	return resp, body, ev
+}
+
+func TestReplyJSON(t *testing.T) {
+	resp, body, ev := serveReply(t,
+		`{"version":1,"action":"modify","header":{"Content-Type":["application/json"],"X-Debugged":["yes"]},"trailer":{"X-Checksum":["changed"]}}`,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Handler", "yes")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":42}`))
+		})
+
+	if ev.Status != http.StatusCreated || ev.Header.Get("X-Handler") != "yes" || ev.Body.Data != `{"id":42}` {
+		t.Errorf("expected the debugger to see the handler's reply, got %d %v '%s'", ev.Status, ev.Header, ev.Body.Data)
+	}
+	if resp.StatusCode != http.StatusCreated || string(body) != `{"id":42}` {
+		t.Errorf("expected status and body to be kept, got %d '%s'", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Debugged") != "yes" || resp.Header.Get("X-Handler") != "" {
+		t.Errorf("expected the debugger's headers, got %v", resp.Header)
+	}
+	if resp.Trailer.Get("X-Checksum") != "changed" {
+		t.Errorf("expected the debugger's trailer, got %v", resp.Trailer)
+	}
+}
+
+func TestReplyGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("hello, compressed world"))
+	zw.Close()
+
+	resp, body, ev := serveReply(t, `{"version":1}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", "999")
+		w.Write(compressed.Bytes())
+	})
+
+	if ev.Body.Data != "hello, compressed world" || ev.Body.ContentEncoding != "gzip" {
+		t.Errorf("expected the debugger to get the reply decoded, got %s '%s'", ev.Body.ContentEncoding, ev.Body.Data)
+	}
+	if !bytes.Equal(body, compressed.Bytes()) || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the gzip reply to pass through untouched, got %v", resp.Header)
+	}
+	if resp.ContentLength != int64(compressed.Len()) {
+		t.Errorf("expected Content-Length to match the body, got %d", resp.ContentLength)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("reply is not gzip: %s", err)
+	}
+	plain, _ := ioutil.ReadAll(zr)
+	if string(plain) != "hello, compressed world" {
+		t.Errorf("unexpected decompressed reply '%s'", plain)
+	}
+}
+
+func TestReplyChunked(t *testing.T) {
+	resp, body, ev := serveReply(t, `{"version":1}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusAccepted)
+		for _, chunk := range []string{"one ", "two ", "three"} {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "def")
+	})
+
+	// a flushed reply is streamed, the trailers come with the last chunk
+	if ev.Chunk != 4 || ev.Body.Data != "" || ev.Trailer.Get("X-Checksum") != "abc" || ev.Trailer.Get("X-Undeclared") != "def" {
+		t.Errorf("expected the debugger to see the trailers with the last chunk, got %d '%s' %v", ev.Chunk, ev.Body.Data, ev.Trailer)
+	}
+	if resp.StatusCode != http.StatusAccepted || string(body) != "one two three" {
+		t.Errorf("unexpected reply %d '%s'", resp.StatusCode, body)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("expected a chunked reply, got %v", resp.TransferEncoding)
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" || resp.Trailer.Get("X-Undeclared") != "def" {
+		t.Errorf("expected trailers to be replayed, got %v", resp.Trailer)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brianm/rpcdb"
+)
+
+// KeyRing owns the keypair used to sign debug sessions. Rotated out
+// keys are still published, and so still valid, for a grace window
+// so that sessions signed just before a rotation keep working.
+type KeyRing struct {
+	mu      sync.RWMutex
+	grace   time.Duration
+	current rpcdb.Ed25519Signer
+	retired []retiredKey
+}
+
+type retiredKey struct {
+	id      string
+	key     ed25519.PublicKey
+	expires time.Time
+}
+
+// NewKeyRing creates a key ring with a freshly generated signing key
+func NewKeyRing(grace time.Duration) (*KeyRing, error) {
+	k := &KeyRing{grace: grace}
+	signer, err := generateSigner()
+	if err != nil {
+		return nil, err
+	}
+	k.current = signer
+	return k, nil
+}
+
+func generateSigner() (rpcdb.Ed25519Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return rpcdb.Ed25519Signer{}, fmt.Errorf("unable to generate signing key: %s", err)
+	}
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return rpcdb.Ed25519Signer{}, fmt.Errorf("unable to generate key id: %s", err)
+	}
+	return rpcdb.Ed25519Signer{ID: hex.EncodeToString(id), Key: priv}, nil
+}
+
+// Sign signs with the current key
+func (k *KeyRing) Sign(message []byte) (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current.Sign(message)
+}
+
+// Rotate generates a new signing key, retiring the current one. The
+// retired key remains published until now + the grace window.
+func (k *KeyRing) Rotate(now time.Time) error {
+	signer, err := generateSigner()
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.retired = append(k.retired, retiredKey{
+		id:      k.current.ID,
+		key:     k.current.Key.Public().(ed25519.PublicKey),
+		expires: now.Add(k.grace),
+	})
+	k.current = signer
+	k.prune(now)
+	return nil
+}
+
+// prune drops retired keys past their grace window, must hold k.mu
+func (k *KeyRing) prune(now time.Time) {
+	live := k.retired[:0]
+	for _, r := range k.retired {
+		if now.Before(r.expires) {
+			live = append(live, r)
+		}
+	}
+	k.retired = live
+}
+
+// Published returns the public keys which are currently valid, the
+// current key first
+func (k *KeyRing) Published(now time.Time) []rpcdb.PublishedKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := []rpcdb.PublishedKey{{
+		ID:        k.current.ID,
+		Algorithm: rpcdb.AlgorithmEd25519,
+		Key:       k.current.Key.Public().(ed25519.PublicKey),
+	}}
+	for _, r := range k.retired {
+		if now.Before(r.expires) {
+			expires := r.expires
+			keys = append(keys, rpcdb.PublishedKey{
+				ID:        r.id,
+				Algorithm: rpcdb.AlgorithmEd25519,
+				Key:       r.key,
+				Expires:   &expires,
+			})
+		}
+	}
+	return keys
+}
+
+// RotateEvery rotates the signing key on a fixed interval, forever
+func (k *KeyRing) RotateEvery(interval time.Duration, logf func(string, ...interface{})) {
+	for now := range time.Tick(interval) {
+		err := k.Rotate(now)
+		if err != nil {
+			logf("unable to rotate signing key: %s", err)
+		}
+	}
+}
+
+// ServeHTTP publishes the current public keys
+func (k *KeyRing) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rpcdb.PublishedKeys{Keys: k.Published(time.Now())})
+}
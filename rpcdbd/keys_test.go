@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianm/rpcdb"
+)
+
+func TestRotatedKeysRemainValidForGrace(t *testing.T) {
+	keys, err := NewKeyRing(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	first := keys.Published(now)[0].ID
+
+	err = keys.Rotate(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := keys.Published(now.Add(30 * time.Minute))
+	if len(published) != 2 || published[1].ID != first {
+		t.Errorf("expected rotated key to still be published, got %v", published)
+	}
+
+	published = keys.Published(now.Add(2 * time.Hour))
+	if len(published) != 1 || published[0].ID == first {
+		t.Errorf("expected rotated key to be gone after grace, got %v", published)
+	}
+}
+
+func TestMintedSessionVerifies(t *testing.T) {
+	keys, err := NewKeyRing(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := httptest.NewServer(keys)
+	defer ks.Close()
+
+	sessions := NewSessions(keys, "http://rpcdbd.internal", time.Minute, time.Hour, []string{"secret"})
+	created, err := sessions.mint("http://rpcdbd.internal", []string{"receive example:/hello"}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate so that the session was signed with a retired key
+	err = keys.Rotate(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := rpcdb.NewKeySet(http.DefaultClient, ks.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rpcdb.VerifySession(verifier, created.Headers, time.Now())
+	if err != nil {
+		t.Errorf("expected minted session to verify: %s", err)
+	}
+}
@@ -1,24 +1,61 @@
 package main
 
 import (
-	"net/http"
-	"log"
+	"encoding/json"
 	"fmt"
+	"github.com/brianm/rpcdb"
 	"github.com/codegangsta/cli"
+	"log"
+	"net/http"
 	"os"
+	"time"
 )
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "rpcdbd"
 	app.Usage = "run rpc debugger server"
-	app.Flags = []cli.Flag {
+	app.Flags = []cli.Flag{
 		cli.IntFlag{
-			Name: "port, p",
-			Value: 8000,
-			Usage: "port to listen on",
+			Name:   "port, p",
+			Value:  8000,
+			Usage:  "port to listen on",
 			EnvVar: "RPCDB_PORT",
 		},
+		cli.StringFlag{
+			Name:   "url",
+			Usage:  "externally reachable base url, used to build Debug-Session urls",
+			EnvVar: "RPCDB_URL",
+		},
+		cli.DurationFlag{
+			Name:   "ttl",
+			Value:  10 * time.Minute,
+			Usage:  "default lifetime of a debug session",
+			EnvVar: "RPCDB_TTL",
+		},
+		cli.DurationFlag{
+			Name:   "max-ttl",
+			Value:  time.Hour,
+			Usage:  "maximum lifetime of a debug session",
+			EnvVar: "RPCDB_MAX_TTL",
+		},
+		cli.DurationFlag{
+			Name:   "rotate",
+			Value:  24 * time.Hour,
+			Usage:  "how often to rotate the session signing key",
+			EnvVar: "RPCDB_ROTATE",
+		},
+		cli.DurationFlag{
+			Name:   "grace",
+			Value:  time.Hour,
+			Usage:  "how long a rotated out key remains valid, must be at least --max-ttl",
+			EnvVar: "RPCDB_GRACE",
+		},
+		cli.StringSliceFlag{
+			Name:   "token",
+			Usage:  "bearer token which may mint debug sessions, minting is disabled without one",
+			EnvVar: "RPCDB_TOKENS",
+		},
 	}
 	app.Action = server
 
@@ -26,17 +63,55 @@ func main() {
 }
 
 func server(c *cli.Context) {
+	// sessions signed just before a rotation must keep verifying until
+	// they expire, so the old key has to outlive the longest session
+	if c.Duration("grace") < c.Duration("max-ttl") {
+		log.Fatalf("--grace %s is shorter than --max-ttl %s", c.Duration("grace"), c.Duration("max-ttl"))
+	}
+	keys, err := NewKeyRing(c.Duration("grace"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go keys.RotateEvery(c.Duration("rotate"), log.Printf)
+
+	tokens := c.StringSlice("token")
+	if len(tokens) == 0 {
+		log.Printf("no --token given, debug sessions cannot be minted")
+	}
+	sessions := NewSessions(keys, c.String("url"), c.Duration("ttl"), c.Duration("max-ttl"), tokens)
+
+	mux := http.NewServeMux()
+	mux.Handle("/keys", keys)
+	mux.Handle("/sessions", sessions)
+	mux.Handle("/sessions/", sessions)
+
 	s := &http.Server{
-		Addr:           fmt.Sprintf(":%d", c.Int("port")),
-		Handler:        &DebugHandler{},
+		Addr:    fmt.Sprintf(":%d", c.Int("port")),
+		Handler: mux,
 	}
 	log.Fatal(s.ListenAndServe())
 }
 
+// DebugHandler is the debugger end of a debug session. It receives
+// rpcdb.Events from middleware and answers each with an rpcdb.Verdict.
+// For now it logs each event and lets the RPC continue unchanged.
 type DebugHandler struct {
-
 }
 
 func (d *DebugHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	res.Write([]byte("hello world"))
+	ev := rpcdb.Event{}
+	err := json.NewDecoder(req.Body).Decode(&ev)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("unable to parse event: %s", err), http.StatusBadRequest)
+		return
+	}
+	if ev.Version != rpcdb.ProtocolVersion {
+		http.Error(res, fmt.Sprintf("unsupported protocol version %d", ev.Version), http.StatusBadRequest)
+		return
+	}
+	log.Printf("%s %s %s %s %s trace=%s span=%s",
+		ev.Service, ev.Hook, ev.Method, ev.URL, ev.Breakpoint, ev.TraceID, ev.SpanID)
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(rpcdb.Verdict{Version: rpcdb.ProtocolVersion})
 }
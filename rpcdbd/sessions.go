@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brianm/rpcdb"
+)
+
+// CreateSession is the body of a request to mint a new debug session
+type CreateSession struct {
+	Breakpoints []string `json:"breakpoints"`
+	// TTL is a duration, such as "10m", defaults to the daemon's --ttl
+	TTL string `json:"ttl,omitempty"`
+}
+
+// CreatedSession describes a newly minted debug session. Headers has
+// the Debug-Session, Debug-Breakpoint, and Debug-Signature headers to
+// add to the initiating request.
+type CreatedSession struct {
+	ID      string      `json:"id"`
+	Expires time.Time   `json:"expires"`
+	Headers http.Header `json:"headers"`
+}
+
+// SignBreakpoints is the body of a request to sign a session's
+// changed breakpoints, see Sessions.sign
+type SignBreakpoints struct {
+	Breakpoints []string `json:"breakpoints"`
+}
+
+// SignedBreakpoints answers SignBreakpoints with the Debug-Signature
+// for a debugger to send back in its verdict
+type SignedBreakpoints struct {
+	Signature string `json:"signature"`
+}
+
+type session struct {
+	id          string
+	url         string
+	breakpoints []string
+	expires     time.Time
+	counters    map[string]*counter
+}
+
+// has reports whether expr is one of the breakpoints the session has
+// been signed for
+func (s session) has(expr string) bool {
+	for _, bp := range s.breakpoints {
+		if strings.TrimSpace(bp) == expr {
+			return true
+		}
+	}
+	return false
+}
+
+// counter tracks hits on a breakpoint with modifiers
+type counter struct {
+	hits  int
+	fired int
+}
+
+// Sessions mints and tracks debug sessions.
+//
+// A minted session is signed, and so is trusted by every service
+// running the middleware to pause, read and rewrite the RPCs its
+// breakpoints match. Minting is therefore only open to callers with
+// one of the configured bearer tokens, and disabled if there are none.
+// The session URLs themselves are capabilities, known only to whoever
+// minted the session and the services it reaches.
+type Sessions struct {
+	mu       sync.Mutex
+	signer   rpcdb.Signer
+	baseURL  string
+	ttl      time.Duration
+	maxTTL   time.Duration
+	tokens   []string
+	sessions map[string]session
+	debugger http.Handler
+}
+
+// NewSessions creates a session registry. baseURL is the externally
+// reachable URL of this daemon, if empty it is inferred from requests.
+// tokens are the bearer tokens which may mint sessions.
+func NewSessions(signer rpcdb.Signer, baseURL string, ttl, maxTTL time.Duration, tokens []string) *Sessions {
+	return &Sessions{
+		signer:   signer,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		ttl:      ttl,
+		maxTTL:   maxTTL,
+		tokens:   tokens,
+		sessions: map[string]session{},
+		debugger: &DebugHandler{},
+	}
+}
+
+// ServeHTTP handles `POST /sessions` to create a session, `POST
+// /sessions/<id>/sign` to sign its breakpoints once a debugger changes
+// them, and requests to `/sessions/<id>` and `/sessions/<id>/hits`
+// which are sent by debug middleware
+func (s *Sessions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/sessions"), "/")
+	if strings.HasSuffix(id, "/hits") {
+		s.hit(w, req, strings.TrimSuffix(id, "/hits"))
+		return
+	}
+	if strings.HasSuffix(id, "/sign") {
+		s.sign(w, req, strings.TrimSuffix(id, "/sign"))
+		return
+	}
+	if id == "" {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.create(w, req)
+		return
+	}
+
+	if _, ok := s.lookup(id, time.Now()); !ok {
+		http.NotFound(w, req)
+		return
+	}
+	s.debugger.ServeHTTP(w, req)
+}
+
+func (s *Sessions) create(w http.ResponseWriter, req *http.Request) {
+	if !s.authorize(w, req) {
+		return
+	}
+
+	cs := CreateSession{}
+	err := json.NewDecoder(req.Body).Decode(&cs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse session request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	ttl := s.ttl
+	if cs.TTL != "" {
+		ttl, err = time.ParseDuration(cs.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl '%s'", cs.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > s.maxTTL {
+		ttl = s.maxTTL
+	}
+
+	if err := checkBreakpoints(cs.Breakpoints); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := s.mint(s.externalURL(req), cs.Breakpoints, time.Now().Add(ttl))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// sign signs a session's breakpoints as changed by a debugger, with the
+// session's expiry, so that the debugger can step into other services.
+// Like minting it needs one of the bearer tokens. Hits are counted for
+// the new breakpoints from then on.
+func (s *Sessions) sign(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, req) {
+		return
+	}
+	sb := SignBreakpoints{}
+	err := json.NewDecoder(req.Body).Decode(&sb)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse breakpoints: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := checkBreakpoints(sb.Breakpoints); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, ok := s.lookup(id, time.Now())
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	sig, err := rpcdb.SignSession(s.signer, sess.url, sb.Breakpoints, sess.expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	if sess, ok := s.sessions[id]; ok {
+		for _, expr := range sb.Breakpoints {
+			if !sess.has(strings.TrimSpace(expr)) {
+				sess.breakpoints = append(sess.breakpoints, expr)
+			}
+		}
+		s.sessions[id] = sess
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SignedBreakpoints{Signature: sig})
+}
+
+// checkBreakpoints makes sure breakpoints parse and can be sent on in
+// Debug-Breakpoint headers
+func checkBreakpoints(breakpoints []string) error {
+	for _, expr := range breakpoints {
+		_, err := rpcdb.ParseExpression(expr)
+		if err != nil {
+			return err
+		}
+		if len(rpcdb.SplitBreakpoints(expr)) != 1 {
+			return fmt.Errorf("breakpoint may only contain ',' in a quoted value: '%s'", expr)
+		}
+	}
+	return nil
+}
+
+// authorize answers req itself, reporting false, unless it carries one
+// of the bearer tokens
+func (s *Sessions) authorize(w http.ResponseWriter, req *http.Request) bool {
+	if len(s.tokens) == 0 {
+		http.Error(w, "signing sessions is disabled, no tokens are configured", http.StatusForbidden)
+		return false
+	}
+	if !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rpcdbd"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authorized reports whether req carries one of the minting tokens
+func (s *Sessions) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := []byte(strings.TrimPrefix(auth, "Bearer "))
+	ok := false
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (s *Sessions) mint(baseURL string, breakpoints []string, expires time.Time) (CreatedSession, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return CreatedSession{}, fmt.Errorf("unable to generate session id: %s", err)
+	}
+	id := hex.EncodeToString(buf)
+	sessionURL := fmt.Sprintf("%s/sessions/%s", baseURL, id)
+
+	sig, err := rpcdb.SignSession(s.signer, sessionURL, breakpoints, expires)
+	if err != nil {
+		return CreatedSession{}, err
+	}
+
+	s.mu.Lock()
+	for old, sess := range s.sessions {
+		if !time.Now().Before(sess.expires) {
+			delete(s.sessions, old)
+		}
+	}
+	s.sessions[id] = session{id, sessionURL, breakpoints, expires, map[string]*counter{}}
+	s.mu.Unlock()
+
+	headers := http.Header{}
+	headers.Set("Debug-Session", sessionURL)
+	for _, bp := range breakpoints {
+		headers.Add("Debug-Breakpoint", bp)
+	}
+	headers.Set("Debug-Signature", sig)
+	return CreatedSession{ID: id, Expires: expires, Headers: headers}, nil
+}
+
+// hit counts a breakpoint hit reported by middleware and decides
+// whether the breakpoint triggers. We are the authority on this as
+// many middleware instances share the count.
+func (s *Sessions) hit(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hr := rpcdb.HitRequest{}
+	err := json.NewDecoder(req.Body).Decode(&hr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse hit: %s", err), http.StatusBadRequest)
+		return
+	}
+	bp, err := rpcdb.ParseExpression(hr.Breakpoint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, ok := s.lookup(id, time.Now())
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if !sess.has(bp.Expression) {
+		// only breakpoints the session was minted with are counted
+		http.Error(w, "breakpoint is not part of the session", http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := sess.counters[bp.Expression]
+	if !ok {
+		c = &counter{}
+		sess.counters[bp.Expression] = c
+	}
+	c.hits++
+	fire, exhausted := bp.Modifiers.Decide(c.hits, c.fired)
+	if fire {
+		c.fired++
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rpcdb.HitReply{Fire: fire, Exhausted: exhausted})
+}
+
+func (s *Sessions) lookup(id string, now time.Time) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if ok && !now.Before(sess.expires) {
+		delete(s.sessions, id)
+		return sess, false
+	}
+	return sess, ok
+}
+
+func (s *Sessions) externalURL(req *http.Request) string {
+	if s.baseURL != "" {
+		return s.baseURL
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, req.Host)
+}
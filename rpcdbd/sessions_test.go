@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianm/rpcdb"
+)
+
+func TestHitCounting(t *testing.T) {
+	keys, _ := NewKeyRing(time.Hour)
+	sessions := NewSessions(keys, "", time.Minute, time.Hour, []string{"secret"})
+	ts := httptest.NewServer(sessions)
+	defer ts.Close()
+
+	created, err := sessions.mint(ts.URL, []string{"receive example:/hello after 1 max 1"}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hitsURL := created.Headers.Get("Debug-Session") + "/hits"
+
+	expected := []rpcdb.HitReply{{Fire: false}, {Fire: true, Exhausted: true}, {Exhausted: true}}
+	for i, want := range expected {
+		resp, err := http.Post(hitsURL, "application/json",
+			strings.NewReader(`{"breakpoint":"receive example:/hello after 1 max 1"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := rpcdb.HitReply{}
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if got != want {
+			t.Errorf("hit %d expected %+v got %+v", i, want, got)
+		}
+	}
+
+	resp, err := http.Post(hitsURL, "application/json",
+		strings.NewReader(`{"breakpoint":"receive example:/other max 1000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a breakpoint outside the session to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestMintingRequiresToken(t *testing.T) {
+	keys, _ := NewKeyRing(time.Hour)
+	for _, tc := range []struct {
+		tokens []string
+		auth   string
+		status int
+	}{
+		{nil, "Bearer secret", http.StatusForbidden},
+		{[]string{"secret"}, "", http.StatusUnauthorized},
+		{[]string{"secret"}, "Bearer wrong", http.StatusUnauthorized},
+		{[]string{"other", "secret"}, "Bearer secret", http.StatusCreated},
+	} {
+		sessions := NewSessions(keys, "http://rpcdbd.internal", time.Minute, time.Hour, tc.tokens)
+		req := httptest.NewRequest("POST", "/sessions", strings.NewReader(`{"breakpoints":["receive example:/hello"]}`))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		sessions.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("tokens %v with '%s': expected %d got %d", tc.tokens, tc.auth, tc.status, w.Code)
+		}
+	}
+}
+
+func TestSigningChangedBreakpoints(t *testing.T) {
+	keys, _ := NewKeyRing(time.Hour)
+	sessions := NewSessions(keys, "http://rpcdbd.internal", time.Minute, time.Hour, []string{"secret"})
+	created, err := sessions.mint("http://rpcdbd.internal", []string{"request frontend:/hello"}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := rpcdb.Ed25519Keys{}
+	for _, k := range keys.Published(time.Now()) {
+		verifier[k.ID] = k.Key
+	}
+
+	changed := []string{"request frontend:/hello", "receive backend:/lookup once"}
+	body, _ := json.Marshal(SignBreakpoints{changed})
+	for _, auth := range []string{"", "Bearer secret"} {
+		req := httptest.NewRequest("POST", "/sessions/"+created.ID+"/sign", bytes.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		sessions.ServeHTTP(w, req)
+		if auth == "" {
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("expected signing without a token to be refused, got %d", w.Code)
+			}
+			continue
+		}
+
+		signed := SignedBreakpoints{}
+		json.NewDecoder(w.Body).Decode(&signed)
+		h := http.Header{}
+		h.Set("Debug-Session", created.Headers.Get("Debug-Session"))
+		for _, expr := range changed {
+			h.Add("Debug-Breakpoint", expr)
+		}
+		h.Set("Debug-Signature", signed.Signature)
+		if err := rpcdb.VerifySession(verifier, h, time.Now()); err != nil {
+			t.Errorf("expected the changed breakpoints to verify: %s", err)
+		}
+	}
+
+	hit := httptest.NewRequest("POST", "/sessions/"+created.ID+"/hits",
+		strings.NewReader(`{"breakpoint":"receive backend:/lookup once"}`))
+	w := httptest.NewRecorder()
+	sessions.ServeHTTP(w, hit)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected hits on a signed breakpoint to be counted, got %d", w.Code)
+	}
+}
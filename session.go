@@ -2,14 +2,17 @@ package rpcdb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
-
-	"encoding/json"
-	"net/http/httptest"
+	"sync"
+	"time"
 )
 
 var debugBreakpointHeaderKey = http.CanonicalHeaderKey("Debug-Breakpoint")
@@ -58,12 +61,34 @@ const (
 	Response
 )
 
-var parsePattern = regexp.MustCompile(`(\w+)\s+(\w+)\:(.+)`)
+var parsePattern = regexp.MustCompile(`^\s*(\w+)\s+([\w\-.*?/\[\]]+)\:(\S+)\s*$`)
+
+var conditionPattern = regexp.MustCompile(`\s+if\s+`)
 
-// ParseExpression parses a single breakpoint expression
+// ParseExpression parses a single breakpoint expression, which may
+// be followed by Modifiers and end with an `if` clause of Conditions,
+// for example
+// `receive billing:/charge once if method == POST && $.amount > 1000`
+//
+// An expression starting with `trace`, such as `trace receive
+// example:/hello`, sends the RPC to the debugger without pausing it.
 func ParseExpression(expr string) (Breakpoint, error) {
-	bp := Breakpoint{}
-	parts := parsePattern.FindStringSubmatch(expr)
+	bp := Breakpoint{Expression: strings.TrimSpace(expr)}
+
+	head, clause := expr, ""
+	if loc := conditionPattern.FindStringIndex(expr); loc != nil {
+		head, clause = expr[:loc[0]], expr[loc[1]:]
+	}
+
+	words := strings.Fields(head)
+	if len(words) > 0 && words[0] == "trace" {
+		bp.Trace = true
+		words = words[1:]
+	}
+	if len(words) < 2 {
+		return bp, fmt.Errorf("unable to parse breakpoint expression '%s'", expr)
+	}
+	parts := parsePattern.FindStringSubmatch(words[0] + " " + words[1])
 	if len(parts) != 4 {
 		return bp, fmt.Errorf("unable to parse breakpoint expression '%s'", expr)
 	}
@@ -73,131 +98,423 @@ func ParseExpression(expr string) (Breakpoint, error) {
 		return bp, err
 	}
 	bp.Hook = hookType
-	bp.ServiceName = parts[2]
+	bp.ServiceName, err = ParseServicePattern(parts[2])
+	if err != nil {
+		return bp, err
+	}
 	bp.RPCName = parts[3]
+
+	bp.Modifiers, err = ParseModifiers(words[2:])
+	if err != nil {
+		return bp, fmt.Errorf("unable to parse breakpoint expression '%s': %s", expr, err)
+	}
+	if bp.Trace && !bp.Modifiers.IsZero() {
+		// counting hits is a round trip to rpcdbd, which would block
+		return bp, fmt.Errorf("trace breakpoint '%s' may not have modifiers", expr)
+	}
+
+	if clause != "" {
+		bp.Conditions, err = ParseConditions(clause)
+		if err != nil {
+			return bp, fmt.Errorf("unable to parse breakpoint expression '%s': %s", expr, err)
+		}
+		for _, c := range bp.Conditions {
+			if c.Subject == "status" && (bp.Hook == Receive || bp.Hook == Request) {
+				return bp, fmt.Errorf("status condition on %s breakpoint '%s' can never hold", bp.Hook, expr)
+			}
+		}
+	}
 	return bp, nil
 }
 
 // Breakpoint represents the parsed breakpoint expression
 type Breakpoint struct {
+	Expression  string
+	Trace       bool
 	Hook        HookType
-	ServiceName string
+	ServiceName ServicePattern
 	RPCName     string
+	Modifiers   Modifiers
+	Conditions  Conditions
 }
 
-// Breakpoints is a broken out view of found breakpoints
+// Session is a debug session as seen by the service serving one RPC:
+// the signed Debug-* headers it came with, and their breakpoints
+// broken out by the hook they apply to.
+//
+// A session is live for the length of the RPC: the debugger may add or
+// remove breakpoints in its Verdict, which changes the breakpoints
+// used by later hooks in the same RPC, and those propagated on to
+// other services by DebugClient.
+//
+// Budget is how long the RPC, and everything it calls, may spend
+// paused at breakpoints. It comes from the Debug-Budget header, capped
+// by the session's expiry. Deadlines are extended by what is left of
+// it, so that time spent with a human does not time the RPC out.
 type Session struct {
-	Name                string
+	Identity            Identity
 	SessionURL          string
+	Signature           string
+	Expires             time.Time
+	Budget              time.Duration
+	TraceID             string
+	Expressions         []string
 	ReceiveBreakpoints  []Breakpoint
 	ReplyBreakpoints    []Breakpoint
 	RequestBreakpoints  []Breakpoint
 	ResponseBreakpoints []Breakpoint
+
+	mu     sync.Mutex
+	paused time.Duration
+
+	// signed is set once a verdict changes the breakpoints without a
+	// new signature, to the breakpoints Signature still covers, which
+	// are what is sent on
+	signed []string
+
+	// config says how to talk to the debugger, and how much of a body
+	// to hold, see settings
+	config *config
+
+	// limiter is the middleware's, when serving a debug request, which
+	// decoded bodies count against
+	limiter *limiter
 }
 
-// BuildSession builds a session from http header information
-func BuildSession(name string, header http.Header) (Session, error) {
-	session := Session{
-		Name:       name,
+// configKey is the context key for the config of the Transport making
+// a request, see settings
+type configKey struct{}
+
+// configure sets the session up to talk to the debugger the way the
+// middleware was configured to
+func (s *Session) configure(c *config) {
+	s.config = c
+}
+
+// settings returns the config for hooks run in ctx: a Transport's, if
+// it was given options, otherwise the session's own
+func (s *Session) settings(ctx context.Context) *config {
+	if c, ok := ctx.Value(configKey{}).(*config); ok {
+		return c
+	}
+	if s.config == nil {
+		return defaultConfig
+	}
+	return s.config
+}
+
+// capture reads body, of size bytes or -1 if that is not known, for
+// the debugger at hook
+func (s *Session) capture(ctx context.Context, hook HookType, body io.ReadCloser, size int64) (*payload, error) {
+	c := s.settings(ctx)
+	return capture(body, size, c.bodyLimits[hook], c.spool, c.spoolDir)
+}
+
+// reserve counts n bytes of decoded body against the middleware's
+// buffer limit, reporting false if they do not fit
+func (s *Session) reserve(n int64) bool {
+	if s.limiter == nil {
+		return true
+	}
+	return s.limiter.reserve(n)
+}
+
+// unreserve gives back bytes counted by reserve
+func (s *Session) unreserve(n int64) {
+	if s.limiter != nil {
+		s.limiter.unreserve(n)
+	}
+}
+
+// verdictLimit bounds the size of a verdict, to leave room for a body
+// as big as any hook's limit after encoding, or is zero for no bound
+func (c *config) verdictLimit() int64 {
+	var max int64
+	for _, n := range c.bodyLimits {
+		if n <= 0 {
+			return 0
+		}
+		if n > max {
+			max = n
+		}
+	}
+	// escaping text can take six bytes to the byte
+	return 6*max + 1<<16
+}
+
+// BuildSession builds a session from http header information. The
+// session talks to the debugger the way opts say, and is refused with
+// ErrSessionNotAllowed if the Debug-Session URL is not allowed by them,
+// see WithAllowedSessions.
+func BuildSession(id Identity, header http.Header, opts ...Option) (*Session, error) {
+	c := defaultConfig
+	if len(opts) > 0 {
+		c = newConfig(opts)
+	}
+	return buildSession(id, header, c)
+}
+
+func buildSession(id Identity, header http.Header, c *config) (*Session, error) {
+	session := &Session{
+		Identity:   id,
 		SessionURL: header.Get(debugSessionHeaderKey),
+		Signature:  header.Get(debugSignatureHeaderKey),
+		TraceID:    header.Get(debugTraceHeaderKey),
+	}
+	if session.TraceID == "" {
+		session.TraceID = newID(16)
 	}
-	breakpoints := header[debugBreakpointHeaderKey]
-	for _, expr := range breakpoints {
+	if session.Signature != "" {
+		_, session.Expires, _, _ = parseSignature(session.Signature)
+	}
+	session.Budget = parseBudget(header.Get(debugBudgetHeaderKey), session.Expires, time.Now())
+	session.configure(c)
+	if err := allowSession(session.SessionURL, c.allowed); err != nil {
+		stats.Add("sessions_rejected", 1)
+		return nil, err
+	}
+	err := session.setBreakpoints(breakpointExpressions(header))
+	return session, err
+}
+
+// setBreakpoints replaces the session's breakpoints. Nothing changes
+// if any of the expressions fails to parse.
+func (s *Session) setBreakpoints(exprs []string) error {
+	var receive, reply, request, response []Breakpoint
+	for _, expr := range exprs {
 		bp, err := ParseExpression(expr)
 		if err != nil {
-			return session, err
+			return err
 		}
 		switch bp.Hook {
 		case Receive:
-			session.ReceiveBreakpoints = append(session.ReceiveBreakpoints, bp)
+			receive = append(receive, bp)
 		case Reply:
-			session.ReplyBreakpoints = append(session.ReplyBreakpoints, bp)
+			reply = append(reply, bp)
 		case Request:
-			session.RequestBreakpoints = append(session.RequestBreakpoints, bp)
+			request = append(request, bp)
 		case Response:
-			session.ResponseBreakpoints = append(session.ResponseBreakpoints, bp)
+			response = append(response, bp)
 		}
 	}
 
-	return session, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Expressions = exprs
+	s.ReceiveBreakpoints = receive
+	s.ReplyBreakpoints = reply
+	s.RequestBreakpoints = request
+	s.ResponseBreakpoints = response
+	return nil
 }
 
-// Receive should be called to exercise any receive break points
-func (s Session) Receive(req *http.Request) (*http.Request, error) {
-	// TODO this nested for/if/if is repeated for every BP match test, refactor to common function
-	for _, bp := range s.ReceiveBreakpoints {
-		// TODO handle wildcard service name matches
-		if bp.ServiceName == s.Name {
-			// TODO handle wildcard endpoint matches
-			if bp.RPCName == req.URL.Path {
-				requestBody, err := ioutil.ReadAll(req.Body)
-				if err != nil {
-					return nil, fmt.Errorf("error reading body: %s", err)
-				}
-				defer req.Body.Close()
+// breakpoints returns the session's current breakpoints for a hook
+func (s *Session) breakpoints(hook HookType) []Breakpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch hook {
+	case Receive:
+		return s.ReceiveBreakpoints
+	case Reply:
+		return s.ReplyBreakpoints
+	case Request:
+		return s.RequestBreakpoints
+	}
+	return s.ResponseBreakpoints
+}
 
-				resp, err := http.Post(s.SessionURL, "text/plain", bytes.NewReader(requestBody))
-				if err != nil {
-					return nil, fmt.Errorf("error calling debugger: %s", err)
-				}
-				defer resp.Body.Close()
+// UpdateBreakpoints applies a Verdict's Add and Remove to a list of
+// breakpoint expressions. Removal is by exact expression, and happens
+// before anything is added. Debuggers use this to compute the list
+// they sign, so it must stay in step with what the middleware does.
+func UpdateBreakpoints(current, add, remove []string) []string {
+	updated := []string{}
+	for _, expr := range current {
+		removed := false
+		for _, r := range remove {
+			if strings.TrimSpace(r) == strings.TrimSpace(expr) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			updated = append(updated, expr)
+		}
+	}
+	for _, expr := range add {
+		updated = append(updated, strings.TrimSpace(expr))
+	}
+	return updated
+}
 
-				debugResponseBody, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return nil, fmt.Errorf("Unable to read debugger response: %s", err)
-				}
-				resp.Body.Close()
+// apply takes on any breakpoint changes, and new signature, in a verdict
+func (s *Session) apply(v Verdict) error {
+	var expires time.Time
+	if v.Signature != "" {
+		var err error
+		_, expires, _, err = parseSignature(v.Signature)
+		if err != nil {
+			return fmt.Errorf("bad signature from debugger: %s", err)
+		}
+	}
+	if len(v.Add) > 0 || len(v.Remove) > 0 {
+		s.mu.Lock()
+		previous := s.Expressions
+		exprs := UpdateBreakpoints(previous, v.Add, v.Remove)
+		s.mu.Unlock()
+		if err := s.setBreakpoints(exprs); err != nil {
+			return fmt.Errorf("bad breakpoint from debugger: %s", err)
+		}
+		if v.Signature == "" {
+			// the old signature does not cover the change, so other
+			// services are sent what it does cover
+			s.mu.Lock()
+			if s.signed == nil {
+				s.signed = previous
+			}
+			s.mu.Unlock()
+		}
+	}
+	if v.Signature != "" {
+		s.mu.Lock()
+		s.Signature, s.Expires = v.Signature, expires
+		s.signed = nil
+		s.mu.Unlock()
+	}
+	return nil
+}
 
-				rb := ReceiveBody{}
-				err = json.Unmarshal(debugResponseBody, &rb)
-				if err != nil {
-					return nil, fmt.Errorf("Unable to parse debugger response: %s", err)
-				}
+// propagate sets the debug headers on an outbound request so that the
+// service being called joins the session, with its current breakpoints
+// as far as the signature covers them
+func (s *Session) propagate(header http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	header.Set(debugSessionHeaderKey, s.SessionURL)
+	header.Del(debugBreakpointHeaderKey)
+	exprs := s.Expressions
+	if s.signed != nil {
+		exprs = s.signed
+	}
+	for _, expr := range exprs {
+		header.Add(debugBreakpointHeaderKey, expr)
+	}
+	header.Del(debugSignatureHeaderKey)
+	if s.Signature != "" {
+		header.Set(debugSignatureHeaderKey, s.Signature)
+	}
+	header.Set(debugTraceHeaderKey, s.TraceID)
+	header.Set(debugBudgetHeaderKey, formatBudget(s.Budget-s.paused))
+}
 
-				newReq, err := http.NewRequest(req.Method, req.URL.String(), strings.NewReader(rb.Body))
-				if err != nil {
-					return nil, fmt.Errorf("unable to construct replacement body from debugger: %s", err)
-				}
+// candidates finds the breakpoints which apply to the service being
+// called and the given RPC, before considering their conditions
+func (s *Session) candidates(breakpoints []Breakpoint, callee Identity, rpc string) []Breakpoint {
+	found := []Breakpoint{}
+	for _, bp := range breakpoints {
+		if bp.Matches(callee, rpc) {
+			found = append(found, bp)
+		}
+	}
+	return found
+}
 
-				for k, vs := range req.Header {
-					for _, v := range vs {
-						newReq.Header.Add(k, v)
-					}
-				}
+// match finds the first breakpoint whose conditions hold for msg and
+// which is not held back by its modifiers. We only ever trigger once
+// per hook, even if multiple breakpoint definitions match. ctx is the
+// RPC's, which bounds asking rpcdbd about modifiers.
+func (s *Session) match(ctx context.Context, breakpoints []Breakpoint, msg message) (Breakpoint, bool, error) {
+	for _, bp := range breakpoints {
+		if bp.Trace || !bp.Conditions.eval(msg) {
+			continue
+		}
+		fire, err := s.hit(ctx, bp)
+		if err != nil {
+			return bp, false, err
+		}
+		if fire {
+			return bp, true, nil
+		}
+	}
+	return Breakpoint{}, false, nil
+}
 
-				// return from inside loop so that we only trigger once, even if
-				// multiple breakpoint definitions match
-				return newReq, nil
+// Receive should be called to exercise any receive break points
+func (s *Session) Receive(req *http.Request) (*http.Request, error) {
+	candidates := s.candidates(s.breakpoints(Receive), s.Identity, req.URL.Path)
+	if len(candidates) > 0 {
+		requestBody, err := s.capture(req.Context(), Receive, req.Body, req.ContentLength)
+		if err != nil {
+			return nil, fmt.Errorf("error reading body: %s", err)
+		}
+		if req.Body != nil {
+			req.Body = requestBody.replay()
+		}
+
+		msg := message{
+			method:  req.Method,
+			url:     req.URL,
+			header:  req.Header,
+			body:    requestBody.head,
+			callee:  s.Identity,
+			payload: requestBody,
+		}
+		s.trace(req.Context(), candidates, msg)
+
+		bp, ok, err := s.match(req.Context(), candidates, msg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return req, nil
+		}
+
+		verdict, err := s.call(req.Context(), s.event(req.Context(), bp, msg))
+		if err != nil {
+			return nil, err
+		}
+		switch verdict.Action {
+		case ActionAbort, ActionRespond:
+			halt, err := verdict.halt()
+			if err != nil {
+				return nil, err
 			}
+			return nil, halt
+		case ActionModify:
+			return rewriteRequest(req, verdict)
 		}
+		return req, nil
 	}
 
 	return req, nil
 }
 
-type ReceiveBody struct {
-	Body string
-}
-
-func (s Session) StartReply(w http.ResponseWriter, req *http.Request) ReplyTrap {
+func (s *Session) StartReply(w http.ResponseWriter, req *http.Request) ReplyTrap {
 	// default config is to not capture, if we find a relevant BP we convert to capture
 	rep := ReplyTrap{
 		writer:    w,
 		debugging: false,
-		recorder:  httptest.NewRecorder(),
 		session:   s,
 	}
 
-	// TODO this nested for/if/if is repeated for every BP match test, refactor to common function
-	for _, bp := range s.ReplyBreakpoints {
-		// TODO handle wildcard service name matches
-		if bp.ServiceName == s.Name {
-			// TODO handle wildcard endpoint matches
-			if bp.RPCName == req.URL.Path {
-				rep.debugging = true
-				return rep
-			}
-		}
+	// an upgraded connection, such as a WebSocket, has no reply to
+	// speak of, so it is passed straight through
+	if isUpgrade(req) {
+		return rep
+	}
+
+	// conditions may depend on the reply, so capture if any breakpoint
+	// might apply and decide whether to call the debugger afterwards
+	rep.candidates = s.candidates(s.breakpoints(Reply), s.Identity, req.URL.Path)
+	if len(rep.candidates) > 0 {
+		rep.debugging = true
+		rep.request = req
+		rep.capture = newCaptureWriter(w)
+		rep.capture.flush = rep.chunk
+		c := s.settings(req.Context())
+		rep.capture.limit = c.bodyLimits[Reply]
+		rep.capture.spool, rep.capture.spoolDir = c.spool, c.spoolDir
+		rep.capture.reserve, rep.capture.unreserve = s.reserve, s.unreserve
 	}
 	return rep
 }
@@ -206,163 +523,443 @@ func (s Session) StartReply(w http.ResponseWriter, req *http.Request) ReplyTrap
 // debugger for consideration. It operates in two parts, first is
 // capture, second is acting on what was captured. To do the "act on"
 // part `FinishReply` must be invoked.
+//
+// A reply which the handler flushes is streamed instead: each flushed
+// chunk is traced, and may trigger a breakpoint, on its own, with the
+// status and headers taken from the first. This keeps server-sent
+// events and long polling working under a reply breakpoint. A reply
+// over the body limit which is not spooled is treated the same way:
+// its start goes through the hook as the first chunk, marked
+// truncated, and the rest passes straight through.
 type ReplyTrap struct {
-	writer    http.ResponseWriter
-	recorder  *httptest.ResponseRecorder
-	debugging bool
-	session   Session
+	writer     http.ResponseWriter
+	capture    *captureWriter
+	debugging  bool
+	session    *Session
+	request    *http.Request
+	candidates []Breakpoint
 }
 
 // CaptureWriter returns the response writer to be used to capture the
 // server reply
 func (r ReplyTrap) CaptureWriter() http.ResponseWriter {
 	if r.debugging {
-		return r.recorder
+		return r.capture
 	} else {
 		return r.writer
 	}
 }
 
-type ReplyBody struct {
-	Body string
+// Started reports whether any of the reply has been sent, after which
+// it is too late to answer in its place
+func (r ReplyTrap) Started() bool {
+	return r.debugging && (r.capture.streaming || r.capture.hijacked)
 }
 
 // FinishReply sends the captured reply to the debugger, if needed, and
 // sends anything needed out to on the real reply. If there is no breakpoint
-// on the reply this is a no-op
-func (r ReplyTrap) FinishReply() error {
-	if r.debugging {
-		// r.recorder has the actual recorded response, now we need to
-		// send it to the debugger
+// on the reply this is a no-op. wrote reports whether any of the reply
+// went out, after which it is too late to answer in its place, even
+// if err is set.
+func (r ReplyTrap) FinishReply() (wrote bool, err error) {
+	if !r.debugging || r.capture.hijacked {
+		return false, nil
+	}
+	if r.capture.streaming {
+		return true, r.finishStream()
+	}
 
-		// just send the body for now, will flesh out debugger protocol
-		// once we validate capture of all four BP types is viable
-		resp, err := http.Post(r.session.SessionURL, "text/plain", r.recorder.Body)
-		if err != nil {
-			return fmt.Errorf("Error making request to debugger: %s", err)
-		}
+	header, trailer := r.capture.captured()
+	body := r.capture.payload()
+	msg := message{
+		method:  r.request.Method,
+		url:     r.request.URL,
+		header:  header,
+		status:  r.capture.status,
+		body:    body.head,
+		callee:  r.session.Identity,
+		trailer: trailer,
+		payload: body,
+	}
+	r.session.trace(r.request.Context(), r.candidates, msg)
 
-		debugReplyBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("unable to read response from debugger: %s", err)
-		}
+	bp, ok, err := r.session.match(r.request.Context(), r.candidates, msg)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return true, r.passThrough()
+	}
 
-		debuggerResponse := ReplyBody{}
-		err = json.Unmarshal(debugReplyBody, &debuggerResponse)
+	// r.capture has the actual captured reply, now we need to send it
+	// to the debugger. Nothing has been written to the real writer, so
+	// keep-alives may go out while it is considered, and must stop
+	// before anything is.
+	stop := keepAlive(r.writer)
+	verdict, err := r.session.call(r.request.Context(), r.session.event(r.request.Context(), bp, msg))
+	stop()
+	if err != nil {
+		return false, err
+	}
+	switch verdict.Action {
+	case ActionAbort, ActionRespond:
+		// nothing has been written yet, so the middleware can
+		// still answer in place of the handler
+		halt, err := verdict.halt()
 		if err != nil {
-			return fmt.Errorf("unable to parse response from debugger: %s", err)
+			return false, err
 		}
-
-		// copy response directly from the recorder to the real response
-		// just as filler for now :-)
-		hdr := r.writer.Header()
-		for k, vs := range hdr {
-			for _, v := range vs {
-				r.writer.Header().Add(k, v)
+		return false, halt
+	case ActionModify:
+		if verdict.Body != nil {
+			b, err := verdict.body(nil)
+			if err != nil {
+				return false, err
 			}
+			body = &payload{head: b}
 		}
-		r.writer.WriteHeader(r.recorder.Code)
+		status := r.capture.status
+		if verdict.Status != 0 {
+			status = verdict.Status
+		}
+		return true, r.write(status, verdict.header(header), verdict.trailer(trailer), body)
+	}
+	return true, r.passThrough()
+}
 
-		/*
-			// code to copy
-			_, err = io.Copy(r.writer, r.recorder.Body)
+// chunk sends one flushed chunk of a streamed reply through the hook,
+// then on to the client. The first chunk also sends the status and
+// headers, which the debugger may change until then. Failing to reach
+// the debugger lets the chunk through, as there is no way to fail a
+// reply once it has started, and the error is reported by FinishReply.
+// Changing the body of a truncated chunk drops the rest of the reply.
+func (r ReplyTrap) chunk(data *payload) error {
+	c := r.capture
+	first := c.chunks == 1
+	header, trailer := c.captured()
+	if !c.finishing {
+		// trailers are only final once the handler is done
+		trailer = nil
+	}
+	msg := message{
+		method:  r.request.Method,
+		url:     r.request.URL,
+		header:  header,
+		status:  c.status,
+		body:    data.head,
+		callee:  r.session.Identity,
+		trailer: trailer,
+		chunk:   c.chunks,
+		payload: data,
+	}
+	r.session.trace(r.request.Context(), r.candidates, msg)
+
+	status := c.status
+	var body io.Reader = data.reader()
+	ended := false
+	bp, ok, err := r.session.match(r.request.Context(), r.candidates, msg)
+	if err == nil && ok {
+		var verdict Verdict
+		stop := func() {}
+		if first {
+			stop = keepAlive(r.writer)
+		}
+		verdict, err = r.session.call(r.request.Context(), r.session.event(r.request.Context(), bp, msg))
+		stop()
+		switch {
+		case err != nil:
+		case verdict.Action == ActionAbort && (verdict.Reset || !first):
+			// the client has part of the reply, dropping the
+			// connection is the only way to tell it that's all
+			panic(http.ErrAbortHandler)
+		case verdict.Action == ActionAbort || verdict.Action == ActionRespond:
+			halt, err := verdict.halt()
 			if err != nil {
-				return fmt.Errorf("Error copying recorded body: %s", err)
+				return err
+			}
+			if first {
+				status, header = halt.Status, halt.Header
+			}
+			r.sendChunk(first, status, header, bytes.NewReader(halt.Body), nil)
+			return errReplyEnded
+		case verdict.Action == ActionModify:
+			if verdict.Body != nil {
+				b, err := verdict.body(nil)
+				if err != nil {
+					return err
+				}
+				body, ended = bytes.NewReader(b), data.truncated
+			}
+			if first && verdict.Status != 0 {
+				status = verdict.Status
 			}
-		*/
-		r.writer.Write([]byte(debuggerResponse.Body))
+			if first {
+				header = verdict.header(header)
+			}
+			trailer = verdict.trailer(trailer)
+		}
 	}
-	return nil
+	r.sendChunk(first, status, header, body, trailer)
+	if ended {
+		return errReplyEnded
+	}
+	return err
 }
 
-type ResponseBody struct {
-	Body string
+// sendChunk writes a chunk of a streamed reply to the client, and the
+// trailers if it is the last
+func (r ReplyTrap) sendChunk(first bool, status int, header http.Header, body io.Reader, trailer http.Header) {
+	if first {
+		for k, vs := range header {
+			r.writer.Header()[k] = vs
+		}
+		r.writer.Header().Del("Content-Length")
+		r.writer.WriteHeader(status)
+	}
+	io.Copy(r.writer, body)
+	for k, vs := range trailer {
+		r.writer.Header()[http.TrailerPrefix+k] = vs
+	}
+	http.NewResponseController(r.writer).Flush()
 }
 
-func (s Session) Response(req *http.Request, resp *http.Response) (*http.Response, error) {
-	// TODO this breakpoint matching logic is totally broken
-	// TODO it matches on current service and name being invoked, not name
-	// TODO of thing being hit, which is what it should, but how do we *know* that name?
-	for _, bp := range s.ResponseBreakpoints {
-		// TODO handle wildcard service name matches
-		if bp.ServiceName == s.Name {
-			// TODO handle wildcard endpoint matches
-			if bp.RPCName == req.URL.Path {
-				// we have a matched breakpoint!  (even if broken matching logic)
-
-				// read the response
-				responseBody, err := ioutil.ReadAll(resp.Body)
-				defer resp.Body.Close()
-				if err != nil {
-					return nil, fmt.Errorf("unable to read response body: %s", err)
-				}
-
-				debugResponse, err := http.Post(s.SessionURL, "text/plain", bytes.NewReader(responseBody))
-				if err != nil {
-					return nil, fmt.Errorf("error calling debug server: %s", err)
-				}
+// finishStream sends whatever the handler wrote after its last flush,
+// with the trailers, as the last chunk
+func (r ReplyTrap) finishStream() error {
+	c := r.capture
+	if c.ended {
+		return c.err
+	}
+	if c.passing {
+		_, trailer := c.captured()
+		for k, vs := range trailer {
+			r.writer.Header()[http.TrailerPrefix+k] = vs
+		}
+		return c.err
+	}
+	if _, trailer := c.captured(); c.body.Len() > 0 || trailer != nil {
+		c.finishing = true
+		c.sendChunk()
+	}
+	return c.err
+}
 
-				debugResponseBody, err := ioutil.ReadAll(debugResponse.Body)
-				if err != nil {
-					return nil, fmt.Errorf("unable to read response from debugger: %s", err)
-				}
-				defer debugResponse.Body.Close()
+// passThrough writes the captured reply out unchanged
+func (r ReplyTrap) passThrough() error {
+	header, trailer := r.capture.captured()
+	return r.write(r.capture.status, header, trailer, r.capture.payload())
+}
 
-				rb := ResponseBody{}
-				err = json.Unmarshal(debugResponseBody, &rb)
-				if err != nil {
-					return nil, fmt.Errorf("unable to parse response from debugger: %s", err)
-				}
+// discard lets go of anything held for the reply once it is done
+func (r ReplyTrap) discard() {
+	if r.debugging {
+		r.capture.discard()
+	}
+}
 
-				resp.Body = ioutil.NopCloser(strings.NewReader(rb.Body))
-				return resp, nil
+// isUpgrade reports whether req asks to switch protocols
+func isUpgrade(req *http.Request) bool {
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
 			}
 		}
 	}
-	return resp, nil
+	return false
 }
 
-type RequestBody struct {
-	Body string
+// write sends a reply out on the real response writer
+func (r ReplyTrap) write(status int, header, trailer http.Header, body *payload) error {
+	for k, vs := range header {
+		r.writer.Header()[k] = vs
+	}
+	if len(trailer) > 0 {
+		// declaring the trailers up front makes net/http send a chunked
+		// reply, rather than buffering it and setting Content-Length
+		r.writer.Header().Del("Content-Length")
+		r.writer.Header().Del("Trailer")
+		for k := range trailer {
+			r.writer.Header().Add("Trailer", k)
+		}
+	} else if r.writer.Header().Get("Content-Length") != "" {
+		r.writer.Header().Set("Content-Length", strconv.FormatInt(body.len(), 10))
+	}
+	r.writer.WriteHeader(status)
+	_, err := io.Copy(r.writer, body.reader())
+	for k, vs := range trailer {
+		r.writer.Header()[k] = vs
+	}
+	return err
 }
 
-// TODO implement this!
-func (s Session) Request(req *http.Request) (*http.Request, error) {
-	for _, bp := range s.RequestBreakpoints {
-		// TODO handle wildcard service name matches
-		if bp.ServiceName == s.Name {
-			// TODO handle wildcard endpoint matches
-			if bp.RPCName == req.URL.Path {
-				// we have a matched breakpoint!  (even if broken matching logic)
+func (s *Session) Response(req *http.Request, resp *http.Response) (*http.Response, error) {
+	callee := Callee(req)
+	candidates := s.candidates(s.breakpoints(Response), callee, req.URL.Path)
+	if len(candidates) > 0 {
+		// read the response
+		responseBody, err := s.capture(req.Context(), Response, resp.Body, resp.ContentLength)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read response body: %s", err)
+		}
+		resp.Body = responseBody.replay()
+
+		msg := message{
+			method:  req.Method,
+			url:     req.URL,
+			header:  resp.Header,
+			status:  resp.StatusCode,
+			body:    responseBody.head,
+			callee:  callee,
+			trailer: resp.Trailer,
+			payload: responseBody,
+		}
+		s.trace(req.Context(), candidates, msg)
 
-				// read the request
-				responseBody, err := ioutil.ReadAll(req.Body)
-				defer req.Body.Close()
-				if err != nil {
-					return nil, fmt.Errorf("unable to read request body: %s", err)
-				}
+		bp, ok, err := s.match(req.Context(), candidates, msg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return resp, nil
+		}
 
-				debugResponse, err := http.Post(s.SessionURL, "text/plain", bytes.NewReader(responseBody))
-				if err != nil {
-					return nil, fmt.Errorf("error calling debug server: %s", err)
-				}
+		verdict, err := s.call(req.Context(), s.event(req.Context(), bp, msg))
+		if err != nil {
+			return nil, err
+		}
+		switch verdict.Action {
+		case ActionAbort, ActionRespond:
+			halt, err := verdict.halt()
+			if err != nil {
+				return nil, err
+			}
+			return nil, halt
+		case ActionModify:
+			body, err := verdict.body(nil)
+			if err != nil {
+				return nil, err
+			}
+			if verdict.Status != 0 {
+				resp.StatusCode = verdict.Status
+				resp.Status = fmt.Sprintf("%d %s", verdict.Status, http.StatusText(verdict.Status))
+			}
+			resp.Header = verdict.header(resp.Header)
+			resp.Trailer = verdict.trailer(resp.Trailer)
+			if verdict.Body != nil {
+				resp.Body.Close()
+				setBody(resp.Header, &resp.Body, &resp.ContentLength, body)
+			}
+		}
+		return resp, nil
+	}
+	return resp, nil
+}
 
-				debugResponseBody, err := ioutil.ReadAll(debugResponse.Body)
-				if err != nil {
-					return nil, fmt.Errorf("unable to read response from debugger: %s", err)
-				}
-				defer debugResponse.Body.Close()
+func (s *Session) Request(req *http.Request) (*http.Request, error) {
+	callee := Callee(req)
+	candidates := s.candidates(s.breakpoints(Request), callee, req.URL.Path)
+	if len(candidates) > 0 {
+		// read the request
+		requestBody, err := s.capture(req.Context(), Request, req.Body, req.ContentLength)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read request body: %s", err)
+		}
+		if req.Body != nil {
+			req.Body = requestBody.replay()
+		}
 
-				rb := ResponseBody{}
-				err = json.Unmarshal(debugResponseBody, &rb)
-				if err != nil {
-					return nil, fmt.Errorf("unable to parse response from debugger: %s", err)
-				}
+		msg := message{
+			method:  req.Method,
+			url:     req.URL,
+			header:  req.Header,
+			body:    requestBody.head,
+			callee:  callee,
+			payload: requestBody,
+		}
+		s.trace(req.Context(), candidates, msg)
+
+		bp, ok, err := s.match(req.Context(), candidates, msg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return req, nil
+		}
 
-				req.Body = ioutil.NopCloser(strings.NewReader(rb.Body))
-				return req, nil
+		verdict, err := s.call(req.Context(), s.event(req.Context(), bp, msg))
+		if err != nil {
+			return nil, err
+		}
+		switch verdict.Action {
+		case ActionAbort, ActionRespond:
+			halt, err := verdict.halt()
+			if err != nil {
+				return nil, err
 			}
+			return nil, halt
+		case ActionModify:
+			return rewriteRequest(req, verdict)
 		}
+		return req, nil
 	}
 	return req, nil
 }
+
+// rewriteRequest applies a modify verdict to a request. Everything the
+// debugger did not change is kept, including the context, RemoteAddr,
+// TLS, and trailers. The original request is left alone.
+func rewriteRequest(req *http.Request, verdict Verdict) (*http.Request, error) {
+	newReq := req.Clone(req.Context())
+	if verdict.Method != "" {
+		newReq.Method = verdict.Method
+	}
+	if verdict.URL != "" {
+		u, err := url.Parse(verdict.URL)
+		if err != nil {
+			return nil, fmt.Errorf("bad url from debugger: %s", err)
+		}
+		// a relative url replaces the path and query, an absolute one
+		// the host as well
+		newReq.URL = req.URL.ResolveReference(u)
+		if u.Host != "" {
+			newReq.Host = u.Host
+		}
+		if req.RequestURI != "" {
+			newReq.RequestURI = newReq.URL.RequestURI()
+		}
+	}
+	if verdict.Header != nil || verdict.Body != nil {
+		newReq.Header = verdict.header(newReq.Header).Clone()
+	}
+	if verdict.Body != nil {
+		body, err := verdict.body(nil)
+		if err != nil {
+			return nil, err
+		}
+		if req.Body != nil {
+			// the original body is not sent, so let go of it
+			req.Body.Close()
+		}
+		setBody(newReq.Header, &newReq.Body, &newReq.ContentLength, body)
+		newReq.TransferEncoding = nil
+		newReq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	if verdict.Body != nil || verdict.URL != "" || verdict.Method != "" {
+		// anything parsed from the old request is stale
+		newReq.Form, newReq.PostForm, newReq.MultipartForm = nil, nil, nil
+	}
+	return newReq, nil
+}
+
+// setBody replaces a request or response body, keeping the
+// Content-Length consistent with it
+func setBody(header http.Header, body *io.ReadCloser, contentLength *int64, b []byte) {
+	*body = ioutil.NopCloser(bytes.NewReader(b))
+	*contentLength = int64(len(b))
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(b)))
+	}
+}
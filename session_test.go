@@ -15,7 +15,7 @@ func TestParseReceiveExpr(t *testing.T) {
 	if bp.Hook != Receive {
 		t.Errorf("expected receive hook, got %s", bp.Hook)
 	}
-	if bp.ServiceName != "example" {
+	if bp.ServiceName.String() != "example" {
 		t.Errorf("expected service=example, got service=%s", bp.ServiceName)
 	}
 	if bp.RPCName != "/hello" {
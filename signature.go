@@ -0,0 +1,310 @@
+package rpcdb
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var debugSignatureHeaderKey = http.CanonicalHeaderKey("Debug-Signature")
+
+// ErrBadSignature is returned when a Debug-Signature does not verify
+var ErrBadSignature = errors.New("debug signature does not verify")
+
+// Verifier checks signatures made by an rpcdbd instance. keyID names
+// the key the signature claims to have been made with.
+type Verifier interface {
+	Verify(keyID string, message, sig []byte) error
+}
+
+// Signer signs debug sessions, it is what rpcdbd uses to mint them
+type Signer interface {
+	Sign(message []byte) (keyID string, sig []byte, err error)
+}
+
+// HMACKeys is a Verifier for shared HMAC-SHA256 keys, indexed by key id
+type HMACKeys map[string][]byte
+
+// Verify checks an HMAC-SHA256 signature
+func (k HMACKeys) Verify(keyID string, message, sig []byte) error {
+	key, ok := k[keyID]
+	if !ok {
+		return fmt.Errorf("unknown signing key '%s'", keyID)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// HMACSigner signs sessions with a shared HMAC-SHA256 key
+type HMACSigner struct {
+	ID  string
+	Key []byte
+}
+
+// Sign computes the HMAC-SHA256 of message
+func (s HMACSigner) Sign(message []byte) (string, []byte, error) {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(message)
+	return s.ID, mac.Sum(nil), nil
+}
+
+// Ed25519Keys is a Verifier for a set of Ed25519 public keys, indexed by key id
+type Ed25519Keys map[string]ed25519.PublicKey
+
+// Verify checks an Ed25519 signature
+func (k Ed25519Keys) Verify(keyID string, message, sig []byte) error {
+	key, ok := k[keyID]
+	if !ok {
+		return fmt.Errorf("unknown signing key '%s'", keyID)
+	}
+	if !ed25519.Verify(key, message, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Ed25519Signer signs sessions with an Ed25519 private key
+type Ed25519Signer struct {
+	ID  string
+	Key ed25519.PrivateKey
+}
+
+// Sign computes the Ed25519 signature of message
+func (s Ed25519Signer) Sign(message []byte) (string, []byte, error) {
+	return s.ID, ed25519.Sign(s.Key, message), nil
+}
+
+// AlgorithmEd25519 identifies Ed25519 keys in PublishedKey
+const AlgorithmEd25519 = "ed25519"
+
+// PublishedKey is a public key as published by rpcdbd. Expires is
+// set on keys which have been rotated out and will stop being
+// accepted at that time.
+type PublishedKey struct {
+	ID        string     `json:"id"`
+	Algorithm string     `json:"alg"`
+	Key       []byte     `json:"key"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// PublishedKeys is the document rpcdbd serves at its keys endpoint
+type PublishedKeys struct {
+	Keys []PublishedKey `json:"keys"`
+}
+
+// FetchEd25519Keys retrieves the public keys published by rpcdbd at
+// url, for use as a Verifier. Keys which have already expired are
+// left out. Keys are fetched once, see NewKeySet for a Verifier which
+// keeps up as rpcdbd rotates them.
+func FetchEd25519Keys(hc *http.Client, url string) (Ed25519Keys, error) {
+	resp, err := hc.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch keys: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch keys: %s", resp.Status)
+	}
+
+	published := PublishedKeys{}
+	err = json.NewDecoder(resp.Body).Decode(&published)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse keys: %s", err)
+	}
+
+	now := time.Now()
+	keys := Ed25519Keys{}
+	for _, k := range published.Keys {
+		if k.Algorithm != AlgorithmEd25519 || len(k.Key) != ed25519.PublicKeySize {
+			continue
+		}
+		if k.Expires != nil && !now.Before(*k.Expires) {
+			continue
+		}
+		keys[k.ID] = ed25519.PublicKey(k.Key)
+	}
+	return keys, nil
+}
+
+// keyRefetchDelay is the least time between fetches of a KeySet, so
+// that requests naming made up key ids cannot hammer rpcdbd
+var keyRefetchDelay = 10 * time.Second
+
+// KeySet is a Verifier for the keys rpcdbd publishes, which refetches
+// them as they are rotated
+type KeySet struct {
+	hc      *http.Client
+	url     string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	keys    Ed25519Keys
+	fetched time.Time
+}
+
+// NewKeySet fetches the keys rpcdbd publishes at url, typically its
+// `/keys` endpoint, and refetches them every refresh so that expired
+// keys are dropped, and whenever a signature names a key it does not
+// have, so that new keys are picked up as soon as they are used. With a
+// refresh of zero or less keys are only refetched for unknown key ids.
+func NewKeySet(hc *http.Client, url string, refresh time.Duration) (*KeySet, error) {
+	keys, err := FetchEd25519Keys(hc, url)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{hc: hc, url: url, refresh: refresh, keys: keys, fetched: time.Now()}, nil
+}
+
+// Verify checks an Ed25519 signature against the latest keys
+func (k *KeySet) Verify(keyID string, message, sig []byte) error {
+	keys, err := k.current(keyID, time.Now())
+	if _, ok := keys[keyID]; !ok && err != nil {
+		return fmt.Errorf("unknown signing key '%s': %s", keyID, err)
+	}
+	return keys.Verify(keyID, message, sig)
+}
+
+// current returns the keys to verify keyID with, refetched first if
+// they are due a refresh or do not have keyID. The keys already held
+// are returned with the error if refetching fails.
+func (k *KeySet) current(keyID string, now time.Time) (Ed25519Keys, error) {
+	k.mu.Lock()
+	keys := k.keys
+	_, known := keys[keyID]
+	since := now.Sub(k.fetched)
+	due := (k.refresh > 0 && since >= k.refresh) || (!known && since >= keyRefetchDelay)
+	if !due {
+		k.mu.Unlock()
+		return keys, nil
+	}
+	// other requests carry on with the keys held while this one fetches
+	k.fetched = now
+	k.mu.Unlock()
+
+	fetched, err := FetchEd25519Keys(k.hc, k.url)
+	if err != nil {
+		return keys, err
+	}
+	k.mu.Lock()
+	k.keys = fetched
+	k.mu.Unlock()
+	return fetched, nil
+}
+
+// SignSession computes the value of the Debug-Signature header for a
+// session URL, its breakpoint expressions and an expiry time. The
+// value looks like `keyid=<id>; expires=<unix seconds>; sig=<base64>`
+func SignSession(s Signer, sessionURL string, breakpoints []string, expires time.Time) (string, error) {
+	keyID, sig, err := s.Sign(signedMessage(sessionURL, breakpoints, expires.Unix()))
+	if err != nil {
+		return "", fmt.Errorf("unable to sign session: %s", err)
+	}
+	return fmt.Sprintf("keyid=%s; expires=%d; sig=%s",
+		keyID, expires.Unix(), base64.RawURLEncoding.EncodeToString(sig)), nil
+}
+
+// VerifySession checks the Debug-Signature header against the
+// Debug-Session and Debug-Breakpoint headers, as of now
+func VerifySession(v Verifier, header http.Header, now time.Time) error {
+	if v == nil {
+		return errors.New("no signature verifier configured")
+	}
+	value := header.Get(debugSignatureHeaderKey)
+	if value == "" {
+		return errors.New("debug request is not signed")
+	}
+
+	keyID, expires, sig, err := parseSignature(value)
+	if err != nil {
+		return err
+	}
+	if !now.Before(expires) {
+		return fmt.Errorf("debug signature expired at %s", expires)
+	}
+
+	message := signedMessage(header.Get(debugSessionHeaderKey), breakpointExpressions(header), expires.Unix())
+	return v.Verify(keyID, message, sig)
+}
+
+// parseSignature breaks a Debug-Signature value into its parts
+func parseSignature(value string) (string, time.Time, []byte, error) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(value, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return "", time.Time{}, nil, fmt.Errorf("malformed debug signature '%s'", value)
+		}
+		fields[kv[0]] = kv[1]
+	}
+
+	expires, err := strconv.ParseInt(fields["expires"], 10, 64)
+	if err != nil {
+		return "", time.Time{}, nil, fmt.Errorf("malformed debug signature expiry: %s", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(fields["sig"])
+	if err != nil {
+		return "", time.Time{}, nil, fmt.Errorf("malformed debug signature: %s", err)
+	}
+	return fields["keyid"], time.Unix(expires, 0), sig, nil
+}
+
+// signedMessage is the canonical form of what a Debug-Signature covers
+func signedMessage(sessionURL string, breakpoints []string, expires int64) []byte {
+	msg := fmt.Sprintf("rpcdb-session\n%s\n%d\n", sessionURL, expires)
+	return []byte(msg + strings.Join(breakpoints, "\n"))
+}
+
+// breakpointExpressions returns all of the breakpoint expressions in
+// the header, in order. Multiple expressions may be combined into one
+// header with `,` so we split on that, see SplitBreakpoints.
+func breakpointExpressions(header http.Header) []string {
+	exprs := []string{}
+	for _, value := range header[debugBreakpointHeaderKey] {
+		exprs = append(exprs, SplitBreakpoints(value)...)
+	}
+	return exprs
+}
+
+// SplitBreakpoints breaks one Debug-Breakpoint header value into the
+// expressions combined in it with `,`. A `,` inside a double quoted
+// condition value, such as `if header.Id =~ "^[0-9]{1,3}$"`, is part of
+// the expression.
+func SplitBreakpoints(value string) []string {
+	exprs := []string{}
+	add := func(expr string) {
+		expr = strings.TrimSpace(expr)
+		if expr != "" {
+			exprs = append(exprs, expr)
+		}
+	}
+	quoted, escaped, start := false, false, 0
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && r == ',':
+			add(value[start:i])
+			start = i + 1
+		}
+	}
+	add(value[start:])
+	return exprs
+}
@@ -0,0 +1,194 @@
+package rpcdb
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func signedHeader(t *testing.T, s Signer, expires time.Time) http.Header {
+	h := http.Header{}
+	h.Add("Debug-Session", "http://rpcdbd/abc123")
+	h.Add("Debug-Breakpoint", "receive example:/hello")
+	h.Add("Debug-Breakpoint", "reply example:/hello, request other:/bye")
+	sig, err := SignSession(s, h.Get("Debug-Session"), breakpointExpressions(h), expires)
+	if err != nil {
+		t.Fatalf("unable to sign: %s", err)
+	}
+	h.Set("Debug-Signature", sig)
+	return h
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	keys := HMACKeys{"k1": []byte("secret")}
+	h := signedHeader(t, HMACSigner{"k1", keys["k1"]}, time.Now().Add(time.Minute))
+
+	if err := VerifySession(keys, h, time.Now()); err != nil {
+		t.Errorf("expected signature to verify: %s", err)
+	}
+	if err := VerifySession(HMACKeys{"k1": []byte("other")}, h, time.Now()); err == nil {
+		t.Error("expected signature with wrong key to fail")
+	}
+	if err := VerifySession(HMACKeys{"k2": []byte("secret")}, h, time.Now()); err == nil {
+		t.Error("expected signature with unknown key id to fail")
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	h := signedHeader(t, Ed25519Signer{"k1", priv}, time.Now().Add(time.Minute))
+
+	if err := VerifySession(Ed25519Keys{"k1": pub}, h, time.Now()); err != nil {
+		t.Errorf("expected signature to verify: %s", err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := VerifySession(Ed25519Keys{"k1": other}, h, time.Now()); err == nil {
+		t.Error("expected signature with wrong key to fail")
+	}
+}
+
+func TestFetchSkipsExpiredKeys(t *testing.T) {
+	live, _, _ := ed25519.GenerateKey(rand.Reader)
+	retired, _, _ := ed25519.GenerateKey(rand.Reader)
+	expired := time.Now().Add(-time.Minute)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(PublishedKeys{Keys: []PublishedKey{
+			{ID: "live", Algorithm: AlgorithmEd25519, Key: live},
+			{ID: "retired", Algorithm: AlgorithmEd25519, Key: retired, Expires: &expired},
+		}})
+	}))
+	defer ts.Close()
+
+	keys, err := FetchEd25519Keys(http.DefaultClient, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys["live"]; !ok || len(keys) != 1 {
+		t.Errorf("expected only the live key, got %v", keys)
+	}
+}
+
+func TestKeySetFollowsRotation(t *testing.T) {
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+	pub2, priv2, _ := ed25519.GenerateKey(rand.Reader)
+	var mu sync.Mutex
+	published := []PublishedKey{{ID: "k1", Algorithm: AlgorithmEd25519, Key: pub1}}
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		json.NewEncoder(w).Encode(PublishedKeys{Keys: published})
+	}))
+	defer ts.Close()
+	publish := func(keys ...PublishedKey) {
+		mu.Lock()
+		published = keys
+		mu.Unlock()
+	}
+
+	keys, err := NewKeySet(http.DefaultClient, ts.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(PublishedKey{ID: "k1", Algorithm: AlgorithmEd25519, Key: pub1},
+		PublishedKey{ID: "k2", Algorithm: AlgorithmEd25519, Key: pub2})
+
+	// an unknown key id is not refetched for straight away
+	h := signedHeader(t, Ed25519Signer{"k2", priv2}, time.Now().Add(time.Minute))
+	for i := 0; i < 3; i++ {
+		if err := VerifySession(keys, h, time.Now()); err == nil {
+			t.Error("expected a key fetched too recently to refetch to be unknown")
+		}
+	}
+	mu.Lock()
+	if fetches != 1 {
+		t.Errorf("expected a single fetch, got %d", fetches)
+	}
+	mu.Unlock()
+
+	defer func(delay time.Duration) { keyRefetchDelay = delay }(keyRefetchDelay)
+	keyRefetchDelay = 0
+	if err := VerifySession(keys, h, time.Now()); err != nil {
+		t.Errorf("expected the new key to be fetched: %s", err)
+	}
+	if err := VerifySession(keys, signedHeader(t, Ed25519Signer{"k1", priv1}, time.Now().Add(time.Minute)), time.Now()); err != nil {
+		t.Errorf("expected the old key to still verify: %s", err)
+	}
+
+	// the retired key is dropped at the next refresh
+	publish(PublishedKey{ID: "k2", Algorithm: AlgorithmEd25519, Key: pub2})
+	keys.refresh = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if err := VerifySession(keys, signedHeader(t, Ed25519Signer{"k1", priv1}, time.Now().Add(time.Minute)), time.Now()); err == nil {
+		t.Error("expected the retired key to be dropped on refresh")
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	keys := HMACKeys{"k1": []byte("secret")}
+	h := signedHeader(t, HMACSigner{"k1", keys["k1"]}, time.Now().Add(time.Minute))
+
+	if err := VerifySession(keys, h, time.Now().Add(2*time.Minute)); err == nil {
+		t.Error("expected expired signature to fail")
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	keys := HMACKeys{"k1": []byte("secret")}
+
+	h := signedHeader(t, HMACSigner{"k1", keys["k1"]}, time.Now().Add(time.Minute))
+	h.Set("Debug-Session", "http://evil/abc123")
+	if err := VerifySession(keys, h, time.Now()); err == nil {
+		t.Error("expected changed session url to fail")
+	}
+
+	h = signedHeader(t, HMACSigner{"k1", keys["k1"]}, time.Now().Add(time.Minute))
+	h.Add("Debug-Breakpoint", "receive example:*")
+	if err := VerifySession(keys, h, time.Now()); err == nil {
+		t.Error("expected added breakpoint to fail")
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	h := http.Header{}
+	h.Add("Debug-Session", "http://rpcdbd/abc123")
+	h.Add("Debug-Breakpoint", "receive example:/hello")
+	if err := VerifySession(HMACKeys{}, h, time.Now()); err == nil {
+		t.Error("expected unsigned session to fail")
+	}
+	if err := VerifySession(nil, h, time.Now()); err == nil {
+		t.Error("expected nil verifier to fail")
+	}
+}
+
+func TestBreakpointExpressionsSplitsCommas(t *testing.T) {
+	h := http.Header{}
+	h.Add("Debug-Breakpoint", "receive example:/hello")
+	h.Add("Debug-Breakpoint", "reply example:/hello , request other:/bye")
+	exprs := breakpointExpressions(h)
+	if len(exprs) != 3 || exprs[1] != "reply example:/hello" || exprs[2] != "request other:/bye" {
+		t.Errorf("unexpected expressions: %v", exprs)
+	}
+}
+
+func TestBreakpointExpressionsKeepQuotedCommas(t *testing.T) {
+	h := http.Header{}
+	h.Add("Debug-Breakpoint", `receive example:/hello if header.Id =~ "^[0-9]{1,3}$", reply example:/hello if header.Note == "a \", b"`)
+	exprs := breakpointExpressions(h)
+	if len(exprs) != 2 || exprs[0] != `receive example:/hello if header.Id =~ "^[0-9]{1,3}$"` ||
+		exprs[1] != `reply example:/hello if header.Note == "a \", b"` {
+		t.Errorf("unexpected expressions: %q", exprs)
+	}
+	for _, expr := range exprs {
+		if _, err := ParseExpression(expr); err != nil {
+			t.Errorf("expected '%s' to parse: %s", expr, err)
+		}
+	}
+}
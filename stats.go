@@ -0,0 +1,13 @@
+package rpcdb
+
+import (
+	"expvar"
+)
+
+// stats are published with expvar as `rpcdb`:
+//
+//	debugger_failures  rpcs which could not be debugged, usually
+//	                   because the debugger could not be reached
+//	sessions_rejected  debug sessions refused because their debugger
+//	                   is not allowed, see WithAllowedSessions
+var stats = expvar.NewMap("rpcdb")
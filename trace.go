@@ -0,0 +1,116 @@
+package rpcdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// traceQueueSize bounds how many trace events may be waiting to be
+// sent, and traceWorkers how many are sent concurrently
+const (
+	traceQueueSize = 1024
+	traceWorkers   = 4
+)
+
+// traceTimeout bounds sending a trace event when the middleware has no
+// response timeout, so that a hung debugger cannot hold on to the
+// workers, which every session shares
+var traceTimeout = 10 * time.Second
+
+// tracer sends trace events to debug sessions in the background, so
+// that tracing never blocks or slows the RPC being traced. When the
+// queue is full events are dropped rather than waiting for room.
+type tracer struct {
+	start   sync.Once
+	queue   chan traceEvent
+	dropped uint64
+}
+
+type traceEvent struct {
+	client      *http.Client
+	url         string
+	contentType string
+	body        []byte
+	timeout     time.Duration
+}
+
+var defaultTracer = &tracer{queue: make(chan traceEvent, traceQueueSize)}
+
+// send queues an event, reporting false if it was dropped
+func (t *tracer) send(ev traceEvent) bool {
+	t.start.Do(func() {
+		for i := 0; i < traceWorkers; i++ {
+			go t.run()
+		}
+	})
+
+	select {
+	case t.queue <- ev:
+		return true
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+		return false
+	}
+}
+
+func (t *tracer) run() {
+	for ev := range t.queue {
+		ev.post()
+	}
+}
+
+// post sends the event, nobody is told if it fails as tracing is best
+// effort
+func (ev traceEvent) post() {
+	ctx, cancel := context.WithTimeout(context.Background(), ev.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ev.url, bytes.NewReader(ev.body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", ev.contentType)
+	resp, err := ev.client.Do(req)
+	if err != nil {
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// trace sends an event to the session for each trace breakpoint in
+// candidates which applies to msg
+func (s *Session) trace(ctx context.Context, candidates []Breakpoint, msg message) {
+	for _, bp := range candidates {
+		if !bp.Trace || !bp.Conditions.eval(msg) {
+			continue
+		}
+		ev := s.event(ctx, bp, msg)
+		if ev.spooled != nil {
+			// the queue is in memory, so a trace only has the start of
+			// a spooled body
+			contentType := ev.Body.ContentType
+			ev.Body = NewBody(msg.body)
+			ev.Body.ContentType = contentType
+			ev.Body.Truncated, ev.Body.Size = true, ev.spooled.size
+			ev.spooled = nil
+		}
+		event, err := json.Marshal(ev)
+		s.unreserve(ev.held)
+		if err != nil {
+			continue
+		}
+		c := s.settings(ctx)
+		timeout := c.responseTimeout
+		if timeout <= 0 {
+			timeout = traceTimeout
+		}
+		defaultTracer.send(traceEvent{c.debugger, s.SessionURL, "application/json", event, timeout})
+	}
+}
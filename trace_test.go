@@ -0,0 +1,53 @@
+package rpcdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceExpr(t *testing.T) {
+	bp, err := ParseExpression("trace receive example:/hello if method == POST")
+	if err != nil {
+		t.Fatalf("unable to parse: %s", err)
+	}
+	if !bp.Trace || bp.Hook != Receive || bp.RPCName != "/hello" || len(bp.Conditions) != 1 {
+		t.Errorf("unexpected breakpoint %+v", bp)
+	}
+
+	if _, err := ParseExpression("trace receive example:/hello once"); err == nil {
+		t.Error("expected trace breakpoint with modifiers to fail to parse")
+	}
+}
+
+func TestTracerDropsWhenFull(t *testing.T) {
+	tr := &tracer{queue: make(chan traceEvent, 1)}
+	// mark the workers as started without starting any, so nothing drains the queue
+	tr.start.Do(func() {})
+
+	if !tr.send(traceEvent{}) {
+		t.Error("expected first event to be queued")
+	}
+	if tr.send(traceEvent{}) {
+		t.Error("expected second event to be dropped")
+	}
+	if tr.dropped != 1 {
+		t.Errorf("expected 1 dropped event, got %d", tr.dropped)
+	}
+}
+
+func TestTraceEventTimesOut(t *testing.T) {
+	hung := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer ds.Close()
+	defer close(hung)
+
+	start := time.Now()
+	traceEvent{http.DefaultClient, ds.URL, "application/json", []byte(`{}`), 20 * time.Millisecond}.post()
+	if time.Since(start) > time.Second {
+		t.Errorf("expected a hung debugger to be given up on, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,188 @@
+package rpcdb
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper which runs the request and
+// response hooks for the debug session attached to each request's
+// context, and passes the session on to the service being called.
+// Requests without a session go straight to Base. Any http.Client can
+// be debugged by swapping in a Transport:
+//
+//	client := &http.Client{Transport: &rpcdb.Transport{}}
+//
+// Request and response breakpoints match against the service being
+// called. That is the identity given to WithCallee on the request's
+// context, if any, otherwise the entry in Hosts for the request's
+// host, otherwise Callee if it is set, otherwise a service named for
+// the host.
+type Transport struct {
+	// Base makes the actual requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+
+	// Hosts maps `host` or `host:port` to the service found there
+	Hosts map[string]Identity
+
+	// Callee is the service every request is addressed to, for clients
+	// which only talk to one service
+	Callee Identity
+
+	config *config
+}
+
+// NewTransport builds a Transport making requests with base. Without
+// opts hooks talk to the debugger the way the session's middleware
+// does. Given opts, hooks use the debugger client, timeouts and body
+// limits they set instead, debugger failures are handled by their
+// policy, and sessions they do not allow are not debugged.
+func NewTransport(base http.RoundTripper, opts ...Option) *Transport {
+	t := &Transport{Base: base}
+	if len(opts) > 0 {
+		t.config = newConfig(opts)
+	}
+	return t
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// RoundTrip implements http.RoundTripper. When the debugger ends the
+// RPC its reply is returned as the response, or a *Halt error if it
+// reset the connection.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	session, ok := ExtractSession(req.Context())
+	if !ok {
+		return t.base().RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	if t.config != nil {
+		if err := allowSession(session.SessionURL, t.config.allowed); err != nil {
+			// like the middleware, carry on as though there were no session
+			stats.Add("sessions_rejected", 1)
+			t.config.logf("rpcdb: not debugging request: %s", err)
+			return t.base().RoundTrip(req)
+		}
+		ctx = context.WithValue(ctx, configKey{}, t.config)
+	}
+	if _, named := ctx.Value(calleeKey{}).(Identity); !named {
+		if callee, found := t.callee(req); found {
+			ctx = WithCallee(ctx, callee)
+		}
+	}
+
+	// the service being called may pause too, so its reply is allowed
+	// to take as long as is left of the budget beyond ctx's deadline
+	ctx, cancel := session.extend(ctx)
+
+	// round trippers must leave the caller's request alone
+	clone := req.Clone(ctx)
+	outReq, err := session.Request(clone)
+	if halt, isHalt := err.(*Halt); isHalt {
+		cancel()
+		return halt.response(req)
+	}
+	if err != nil {
+		if err = t.failed(err); err != nil {
+			cancel()
+			return failure(req, err)
+		}
+		// Request leaves the request untouched when it fails
+		outReq = clone
+	}
+
+	// carry the session on to the service being called, including any
+	// breakpoints the debugger just added, so that it can step into it
+	session.propagate(outReq.Header)
+
+	resp, err := t.base().RoundTrip(outReq)
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	received := resp
+	resp, err = session.Response(outReq, resp)
+	if halt, isHalt := err.(*Halt); isHalt {
+		cancel()
+		return halt.response(req)
+	}
+	if err != nil {
+		if err = t.failed(err); err != nil {
+			cancel()
+			received.Body.Close()
+			return failure(req, err)
+		}
+		// Response leaves the response untouched when it fails
+		resp = received
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// failed handles a failure to debug a request according to the
+// failure policy. It returns nil if the request should carry on as
+// though nothing happened, otherwise the error, or a *Halt to answer
+// with.
+func (t *Transport) failed(err error) error {
+	c := t.config
+	if c == nil {
+		c = defaultConfig
+	}
+	stats.Add("debugger_failures", 1)
+	if c.failure.open {
+		c.logf("rpcdb: debugging failed, carrying on: %s", err)
+		return nil
+	}
+	c.logf("rpcdb: debugging failed: %s", err)
+	if c.failure.status == 0 {
+		return err
+	}
+	return &Halt{
+		Status: c.failure.status,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   []byte(err.Error()),
+	}
+}
+
+// failure answers req with err, which is turned into a response if it
+// is a *Halt
+func failure(req *http.Request, err error) (*http.Response, error) {
+	if halt, isHalt := err.(*Halt); isHalt {
+		return halt.response(req)
+	}
+	return nil, err
+}
+
+// cancelBody releases the extended context of a request once its
+// response has been read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// callee looks up the service req is addressed to in Hosts and Callee
+func (t *Transport) callee(req *http.Request) (Identity, bool) {
+	if id, ok := t.Hosts[req.URL.Host]; ok {
+		return id, true
+	}
+	if id, ok := t.Hosts[req.URL.Hostname()]; ok {
+		return id, true
+	}
+	if t.Callee != (Identity{}) {
+		return t.Callee, true
+	}
+	return Identity{}, false
+}
@@ -0,0 +1,63 @@
+package rpcdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	var seen http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+		w.Write([]byte("hello world"))
+	}))
+	defer ts.Close()
+
+	ds := debugger(`{"version":1,"action":"modify","body":{"data":"TRANSFORMED"}}`)
+	defer ds.Close()
+
+	h := http.Header{}
+	h.Add("Debug-Session", ds.URL)
+	h.Add("Debug-Breakpoint", "response example:/")
+	session, _ := BuildSession(Identity{Service: "example"}, h)
+
+	client := &http.Client{Transport: &Transport{Callee: Identity{Service: "example"}}}
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req = req.WithContext(AttachSession(context.Background(), session))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "TRANSFORMED" {
+		t.Errorf("expected response hook to modify body, got '%s'", body)
+	}
+	if seen.Get("Debug-Session") != ds.URL || seen.Get("Debug-Breakpoint") != "response example:/" {
+		t.Errorf("expected debug headers on outbound request, got %v", seen)
+	}
+	if req.Header.Get("Debug-Session") != "" {
+		t.Errorf("expected caller's request to be left alone, got %v", req.Header)
+	}
+}
+
+func TestTransportWithoutSession(t *testing.T) {
+	var seen http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+		w.Write([]byte("hello world"))
+	}))
+	defer ts.Close()
+
+	resp, err := (&http.Client{Transport: &Transport{}}).Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello world" || seen.Get("Debug-Session") != "" {
+		t.Errorf("expected plain request without a session, got '%s' %v", body, seen)
+	}
+}